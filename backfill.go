@@ -0,0 +1,166 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/cryptogo"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_BACKFILL_BLOCKS = 1000
+	DEFAULT_MAX_BACKFILL_SIZE   = 256 * 1024 * 1024 // 256Mb
+	DEFAULT_BACKFILL_TIMEOUT    = 2 * time.Minute
+)
+
+// ErrBackfillExceeded is returned when a broadcaster supplies more ancestors than the server allows.
+type ErrBackfillExceeded struct {
+	Reason string
+}
+
+func (e ErrBackfillExceeded) Error() string {
+	return fmt.Sprintf("Back-fill exceeded %s", e.Reason)
+}
+
+// backfill requests the ancestors of the block missing from the cache, until one is found or the genesis block is reached.
+func (s *Server) backfill(address string, reader *bufio.Reader, writer *bufio.Writer, version uint64, cache bcgo.Cache, channel string, block *bcgo.Block) error {
+	var deadline time.Time
+	if s.BackfillTimeout > 0 {
+		deadline = time.Now().Add(s.BackfillTimeout)
+	}
+	var count int
+	var size uint64
+	for h := block.Previous; len(h) > 0; {
+		if _, err := cache.Block(h); err == nil {
+			// Chain joins a known block
+			return nil
+		}
+		if s.awaitFlight(channel, h) {
+			// Block was being broadcast by another peer, check whether it was accepted
+			if _, err := cache.Block(h); err == nil {
+				return nil
+			}
+		}
+		switch {
+		case s.MaxBackfillBlocks > 0 && count >= s.MaxBackfillBlocks:
+			return ErrBackfillExceeded{fmt.Sprintf("%d blocks", s.MaxBackfillBlocks)}
+		case !deadline.IsZero() && time.Now().After(deadline):
+			return ErrBackfillExceeded{s.BackfillTimeout.String()}
+		}
+		// Request block from broadcaster
+		if err := writeMissing(writer, version, &bcgo.Reference{
+			ChannelName: channel,
+			BlockHash:   h,
+		}); err != nil {
+			return err
+		}
+		data, err := s.readRequest(address, reader, network.PORT_BROADCAST)
+		if err != nil {
+			return err
+		}
+		count++
+		size += uint64(len(data))
+		if s.MaxBackfillSize > 0 && size > s.MaxBackfillSize {
+			return ErrBackfillExceeded{fmt.Sprintf("%d bytes", s.MaxBackfillSize)}
+		}
+		b := &bcgo.Block{}
+		if err := proto.Unmarshal(data, b); err != nil {
+			s.peerEvent(address, EVENT_MALFORMED)
+			return err
+		}
+		bh, err := cryptogo.HashProtobuf(b)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(h, bh) {
+			s.peerEvent(address, EVENT_WRONG_BLOCK)
+			return errors.New("Got wrong block from broadcaster")
+		}
+		if err := cache.PutBlock(h, b); err != nil {
+			return err
+		}
+		h = b.Previous
+	}
+	return nil
+}
+
+// ErrStagingFlush is returned when the staged blocks could not be written before a channel's head.
+type ErrStagingFlush struct {
+	Err error
+}
+
+func (e ErrStagingFlush) Error() string {
+	return fmt.Sprintf("Could not write staged blocks: %s", e.Err)
+}
+
+// stagingCache holds the blocks put into it until a head is put, and then writes them to the underlying cache before the head,
+// so a broadcast chain is only persisted once the channel has accepted it, and a head never refers to a missing block.
+type stagingCache struct {
+	bcgo.Cache
+	blocks map[string]*bcgo.Block
+	order  [][]byte
+}
+
+func newStagingCache(cache bcgo.Cache) *stagingCache {
+	return &stagingCache{
+		Cache:  cache,
+		blocks: make(map[string]*bcgo.Block),
+	}
+}
+
+func (c *stagingCache) Block(hash []byte) (*bcgo.Block, error) {
+	if b, ok := c.blocks[base64.RawURLEncoding.EncodeToString(hash)]; ok {
+		return b, nil
+	}
+	return c.Cache.Block(hash)
+}
+
+func (c *stagingCache) PutBlock(hash []byte, block *bcgo.Block) error {
+	key := base64.RawURLEncoding.EncodeToString(hash)
+	if _, ok := c.blocks[key]; !ok {
+		c.order = append(c.order, hash)
+	}
+	c.blocks[key] = block
+	return nil
+}
+
+func (c *stagingCache) PutHead(channel string, reference *bcgo.Reference) error {
+	for _, h := range c.order {
+		if err := c.Cache.PutBlock(h, c.blocks[base64.RawURLEncoding.EncodeToString(h)]); err != nil {
+			return ErrStagingFlush{err}
+		}
+	}
+	c.order = nil
+	return c.Cache.PutHead(channel, reference)
+}
+
+// staged returns the blocks put into the cache since it was created, in the order they were put.
+func (c *stagingCache) staged() []*bcgo.Block {
+	var blocks []*bcgo.Block
+	for _, h := range c.order {
+		blocks = append(blocks, c.blocks[base64.RawURLEncoding.EncodeToString(h)])
+	}
+	return blocks
+}
@@ -17,45 +17,504 @@
 package bcnetgo
 
 import (
+	"aletheiaware.com/aliasgo"
 	"aletheiaware.com/bcgo"
 	"aletheiaware.com/bcgo/network"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func BindAllTCP(c bcgo.Cache, n *network.TCP, cb func(string) (bcgo.Channel, error)) {
-	// Serve Connect Requests
-	go BindTCP(network.PORT_CONNECT, ConnectPortTCPHandler(n, func(string, string) bool {
-		return true
-	}))
-	// Serve Block Requests
-	go BindTCP(network.PORT_GET_BLOCK, BlockPortTCPHandler(c))
-	// Serve Head Requests
-	go BindTCP(network.PORT_GET_HEAD, HeadPortTCPHandler(c))
-	// Serve Block Updates
-	go BindTCP(network.PORT_BROADCAST, BroadcastPortTCPHandler(c, n, cb))
+var (
+	ErrServerClosed     = errors.New("Server closed")
+	ErrServerNotCreated = errors.New("Server not created by NewServer")
+)
+
+// Ports lists the ports served by a Server, in the order they are bound.
+var Ports = []int{
+	network.PORT_CONNECT,
+	network.PORT_GET_BLOCK,
+	network.PORT_GET_HEAD,
+	network.PORT_BROADCAST,
 }
 
-func BindTCP(port int, handler func(net.Conn)) {
-	address, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.Println("Error resolving", err)
-		return
+// Server serves the connect, block, head, and broadcast ports until it is shutdown.
+// A Server must be created by NewServer, which sets the defaults and internal state, its zero value is not usable.
+type Server struct {
+	Cache   bcgo.Cache
+	Network *network.TCP
+	Open    func(string) (bcgo.Channel, error)
+	Allowed func(string, string) bool
+	// Index, if set, is used to find the block containing a record instead of searching the chain, and must be kept up to date by the caller.
+	// If Cache is an IndexedCache its index is used instead, as the IndexedCache keeps it up to date.
+	Index RecordIndex
+	// Policy, if set, decides which peers may read from and write to each channel.
+	Policy ChannelPolicy
+	// AliasTimeout bounds how long an alias verified on the connect port is used to authorize the peer's other connections.
+	AliasTimeout time.Duration
+	// Reputation, if set, scores peers by the events observed by the handlers, and refuses connections from banned peers.
+	Reputation *Reputation
+	// PeerStore, if set, remembers the peers observed by the handlers, and the stored peers are added to the network when the server starts.
+	PeerStore PeerStore
+	// PeerFlushInterval is how often the PeerStore is flushed while the server runs, it is also flushed by Shutdown.
+	PeerFlushInterval time.Duration
+	// MaxSubscriptions limits the number of channels a connection to the get head port may subscribe to, zero means unlimited.
+	MaxSubscriptions int
+	// HeartbeatInterval is how often a heartbeat is sent to subscribers when no head has changed.
+	HeartbeatInterval time.Duration
+	// SubscriptionTimeout limits how long a subscription lasts, zero means until the client disconnects.
+	SubscriptionTimeout time.Duration
+	// List returns the names of the channels known to the server, and is required to answer head requests by prefix.
+	List func() []string
+	// MaxHeads limits the number of heads returned in a single response, zero means unlimited.
+	MaxHeads int
+	// MaxSnapshotBlocks limits the number of blocks sent in a snapshot, zero means unlimited.
+	MaxSnapshotBlocks uint64
+	// WebSocketOrigins lists the origins, such as "https://example.com", browsers may open WebSocket connections from, "*" allows any.
+	// If empty, only the origin of the WebSocketHandler itself is allowed.
+	WebSocketOrigins []string
+	// TrustedProxies lists the addresses, such as "10.0.0.1" or "10.0.0.0/8", of reverse proxies in front of the WebSocketHandler.
+	// Requests from them are attributed to the client given in X-Forwarded-For.
+	TrustedProxies []string
+	// Multiplex serves all four protocols on PORT_MULTIPLEX instead of on their own ports, see MultiplexHandler.
+	Multiplex bool
+	// Validators maps a channel name to the validators run in order on blocks broadcast to it.
+	Validators map[string][]BlockValidator
+	// Verify, if set, authenticates peers which connect with the handshake protocol.
+	Verify AliasVerifier
+	// Identities lists the addresses and names clients may dial the server by, in addition to the address a connection was accepted on.
+	// A client which signs the handshake for another server is refused, so a signature cannot be relayed.
+	Identities []string
+	// Unverified decides whether a peer which has not authenticated is added to the network.
+	// If nil, unverified peers are only added when Verify is nil.
+	Unverified func(string, string) bool
+	// Versions lists the protocol versions served alongside the legacy protocol, all SupportedVersions if empty.
+	Versions []uint64
+	// Features lists the optional features offered to peers during the connect handshake.
+	Features []string
+	// Address maps a port to the address it is bound to, if absent all interfaces are bound.
+	// An address without a port, such as "127.0.0.1" or "::1", is bound on the default port.
+	Address map[int]string
+	// Listener maps a port to an already open listener, which is used instead of binding an address.
+	Listener map[int]net.Listener
+	// TLSConfig, if set, wraps every listener in TLS.
+	// Set ClientAuth and ClientCAs to only accept peers presenting a trusted certificate.
+	TLSConfig *tls.Config
+	// DialTLSConfig is used to dial peers when TLSConfig is set, if nil ClientTLSConfig(TLSConfig) is used.
+	DialTLSConfig *tls.Config
+	// HandshakeTimeout bounds the wait for the first bytes of a connection, including any TLS handshake.
+	HandshakeTimeout time.Duration
+	// ReadTimeout and WriteTimeout bound each subsequent read and write.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// SessionTimeout bounds the whole time a connection is handled.
+	SessionTimeout time.Duration
+	// MaxConnections caps the connections handled at once across all ports, zero is unlimited.
+	// NewServer sets it to DEFAULT_MAX_CONNECTIONS.
+	MaxConnections int
+	// MaxConnectionsPerIP caps the connections handled at once from a single remote IP, zero is unlimited.
+	// NewServer sets it to DEFAULT_MAX_CONNECTIONS_PER_IP.
+	MaxConnectionsPerIP int
+	// RateLimit maps a port to the rate at which each remote IP may connect to it.
+	RateLimit map[int]Rate
+	// MaxRequestSize maps a port to the largest request accepted on it in bytes,
+	// ports not present accept DEFAULT_MAX_REFERENCE_SIZE, DEFAULT_MAX_HEAD_REQUEST_SIZE for heads, or DEFAULT_MAX_BLOCK_SIZE for broadcasts.
+	MaxRequestSize map[int]uint64
+	// MaxRangeBlocks caps the blocks streamed in response to a range request, zero is unlimited.
+	MaxRangeBlocks uint64
+	// MaxBackfillBlocks, MaxBackfillSize and BackfillTimeout bound the missing ancestors a broadcaster is asked for,
+	// by count, total bytes and wall time respectively, zero is unlimited.
+	MaxBackfillBlocks int
+	MaxBackfillSize   uint64
+	BackfillTimeout   time.Duration
+	// Relay, if set, forwards accepted broadcasts to up to RelayFanout other peers, zero is all peers.
+	// RelayQueue is the number of blocks waiting to be relayed before broadcasters are made to wait.
+	Relay       bool
+	RelayFanout int
+	RelayQueue  int
+	// MaxPeerList caps the peers shared with a client which asks for them, zero is unlimited.
+	MaxPeerList int
+	// Dial, if set, opens connections to peers, such as when relaying.
+	Dial func(string, int) (net.Conn, error)
+
+	mutex         sync.Mutex
+	handlers      map[int]func(net.Conn)
+	listeners     map[int]net.Listener
+	conns         map[net.Conn]bool
+	connsPerIP    map[string]int
+	buckets       map[bucketKey]*bucket
+	rejecting     int
+	peerErrors    map[string]*peerErrorCount
+	capabilities  map[string]Capabilities
+	aliases       map[string]verifiedAlias
+	private       map[string]bool
+	flights       map[string]*flight
+	subscriptions map[string]map[*subscription]bool
+	updates       map[string]*sync.Mutex
+	relays        chan relayItem
+	relayed       *hashSet
+	stopped       chan struct{}
+	serving       sync.WaitGroup
+	errors        chan error
+	shutdown      bool
+	metrics       Metrics
+}
+
+// NewServer returns a Server for the given cache, network, and channel opener, with the default limits and timeouts.
+// The exported fields may be changed before the server is started.
+func NewServer(cache bcgo.Cache, network *network.TCP, open func(string) (bcgo.Channel, error)) *Server {
+	return &Server{
+		Cache:   cache,
+		Network: network,
+		Open:    open,
+		Allowed: func(string, string) bool {
+			return true
+		},
+		Features:            SupportedFeatures,
+		HandshakeTimeout:    DEFAULT_HANDSHAKE_TIMEOUT,
+		ReadTimeout:         DEFAULT_READ_TIMEOUT,
+		WriteTimeout:        DEFAULT_WRITE_TIMEOUT,
+		SessionTimeout:      DEFAULT_SESSION_TIMEOUT,
+		PeerFlushInterval:   DEFAULT_PEER_FLUSH_INTERVAL,
+		AliasTimeout:        DEFAULT_ALIAS_TIMEOUT,
+		MaxConnections:      DEFAULT_MAX_CONNECTIONS,
+		MaxConnectionsPerIP: DEFAULT_MAX_CONNECTIONS_PER_IP,
+		MaxRangeBlocks:      DEFAULT_MAX_RANGE_BLOCKS,
+		MaxBackfillBlocks:   DEFAULT_MAX_BACKFILL_BLOCKS,
+		MaxBackfillSize:     DEFAULT_MAX_BACKFILL_SIZE,
+		BackfillTimeout:     DEFAULT_BACKFILL_TIMEOUT,
+		RelayFanout:         DEFAULT_RELAY_FANOUT,
+		RelayQueue:          DEFAULT_RELAY_QUEUE,
+		MaxPeerList:         DEFAULT_MAX_PEER_LIST,
+		MaxSubscriptions:    DEFAULT_MAX_SUBSCRIPTIONS,
+		MaxHeads:            DEFAULT_MAX_HEADS,
+		MaxSnapshotBlocks:   DEFAULT_MAX_SNAPSHOT_BLOCKS,
+		HeartbeatInterval:   DEFAULT_HEARTBEAT_INTERVAL,
+		SubscriptionTimeout: DEFAULT_SUBSCRIPTION_TIMEOUT,
+		conns:               make(map[net.Conn]bool),
+		connsPerIP:          make(map[string]int),
+		buckets:             make(map[bucketKey]*bucket),
+		peerErrors:          make(map[string]*peerErrorCount),
+		capabilities:        make(map[string]Capabilities),
+		aliases:             make(map[string]verifiedAlias),
+		private:             make(map[string]bool),
+		flights:             make(map[string]*flight),
+		subscriptions:       make(map[string]map[*subscription]bool),
+		updates:             make(map[string]*sync.Mutex),
+		relayed:             newHashSet(MAX_RELAYED_HASHES),
+		stopped:             make(chan struct{}),
+		errors:              make(chan error, len(Ports)),
 	}
-	l, err := net.ListenTCP("tcp", address)
-	if err != nil {
-		log.Println("Error listening", err)
-		return
+}
+
+// Handlers returns the connection handler for each port.
+func (s *Server) Handlers() map[int]func(net.Conn) {
+	return map[int]func(net.Conn){
+		// Serve Connect Requests
+		network.PORT_CONNECT: s.ConnectPortTCPHandler,
+		// Serve Block Requests
+		network.PORT_GET_BLOCK: s.BlockPortTCPHandler,
+		// Serve Head Requests
+		network.PORT_GET_HEAD: s.HeadPortTCPHandler,
+		// Serve Block Updates
+		network.PORT_BROADCAST: s.BroadcastPortTCPHandler,
 	}
-	defer l.Close()
-	log.Println("Listening on", address)
+}
+
+// Start binds all ports, or only PORT_MULTIPLEX if Multiplex is set, and serves connections in the background.
+// If any port cannot be bound, those already bound are closed and the error is returned.
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped == nil {
+		return ErrServerNotCreated
+	}
+	if s.shutdown {
+		return ErrServerClosed
+	}
+	if len(s.listeners) > 0 {
+		return errors.New("Server already started")
+	}
+	ports := Ports
+	handlers := s.Handlers()
+	config := s.TLSConfig
+	if s.handlers != nil {
+		ports = nil
+		for port := range s.handlers {
+			ports = append(ports, port)
+		}
+		handlers = s.handlers
+	} else if s.Multiplex {
+		ports = []int{PORT_MULTIPLEX}
+		handlers = map[int]func(net.Conn){
+			PORT_MULTIPLEX: s.MultiplexHandler,
+		}
+		if config != nil {
+			config = multiplexTLSConfig(config)
+		}
+	}
+	listeners := make(map[int]net.Listener)
+	for _, port := range ports {
+		if l, ok := s.Listener[port]; ok {
+			listeners[port] = l
+			continue
+		}
+		l, err := listenTCP(s.address(port))
+		if err != nil {
+			for p, l := range listeners {
+				if _, ok := s.Listener[p]; !ok {
+					l.Close()
+				}
+			}
+			return err
+		}
+		listeners[port] = l
+	}
+	if config != nil {
+		for port, l := range listeners {
+			listeners[port] = tls.NewListener(l, config)
+		}
+	}
+	if err := s.loadPeers(); err != nil {
+		for p, l := range listeners {
+			if _, ok := s.Listener[p]; !ok {
+				l.Close()
+			}
+		}
+		return err
+	}
+	s.listeners = listeners
+	if s.Relay {
+		s.startRelay()
+	}
+	if s.PeerStore != nil && s.PeerFlushInterval > 0 {
+		s.startPeerFlush()
+	}
+	for _, port := range ports {
+		s.serving.Add(1)
+		go s.serve(port, listeners[port], handlers[port])
+	}
+	return nil
+}
+
+// Addr returns the address the given port is bound to, or nil if the server has not been started.
+func (s *Server) Addr(port int) net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if l, ok := s.listeners[port]; ok {
+		return l.Addr()
+	}
+	return nil
+}
+
+func (s *Server) address(port int) string {
+	address, ok := s.Address[port]
+	if !ok {
+		return fmt.Sprintf(":%d", port)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		// Address has no port, so use the default
+		return net.JoinHostPort(strings.Trim(address, "[]"), strconv.Itoa(port))
+	}
+	return address
+}
+
+// Errors returns a channel which receives any error that stops a port being served before shutdown.
+func (s *Server) Errors() <-chan error {
+	return s.errors
+}
+
+// Shutdown closes all listeners and waits for in-flight connections to be handled.
+// If the context expires first, any remaining connections are closed and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.stopped == nil {
+		s.mutex.Unlock()
+		return ErrServerNotCreated
+	}
+	if !s.shutdown {
+		close(s.stopped)
+	}
+	s.shutdown = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return s.save()
+	case <-ctx.Done():
+		s.mutex.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.mutex.Unlock()
+		s.save()
+		return ctx.Err()
+	}
+}
+
+// save persists the reputation and peer store, returning the first error.
+func (s *Server) save() error {
+	var err error
+	if s.Reputation != nil {
+		err = s.Reputation.Save()
+	}
+	if s.PeerStore != nil {
+		if e := s.PeerStore.Flush(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Server) serve(port int, l net.Listener, handler func(net.Conn)) {
+	defer s.serving.Done()
+	log.Println("Listening on", l.Addr())
 	for {
-		conn, err := l.AcceptTCP()
+		conn, err := l.Accept()
 		if err != nil {
-			log.Println("Error accepting", err)
+			s.mutex.Lock()
+			shutdown := s.shutdown
+			s.mutex.Unlock()
+			if !shutdown {
+				log.Println("Error accepting", err)
+				select {
+				case s.errors <- err:
+				default:
+				}
+			}
 			return
 		}
-		go handler(conn)
+		ip, err := s.accept(port, conn)
+		if err == ErrServerClosed {
+			conn.Close()
+			return
+		} else if err == errRateLimited {
+			log.Println(conn.RemoteAddr(), err)
+			go s.rejectRateLimited(conn)
+			continue
+		} else if err != nil {
+			log.Println(conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.finish(conn, ip)
+			handler(s.withTimeouts(conn))
+		}()
+	}
+}
+
+// accept admits the connection to the given port unless it is banned or exceeds a limit, and tracks it until finish is called.
+// ErrServerClosed is returned if the server has been shutdown.
+func (s *Server) accept(port int, conn net.Conn) (string, error) {
+	ip := remoteIP(conn)
+	if s.banned(conn.RemoteAddr().String()) {
+		s.count(func(m *Metrics) {
+			m.Banned++
+		})
+		return "", errors.New("Banned")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped == nil {
+		return "", ErrServerNotCreated
+	}
+	if s.shutdown {
+		return "", ErrServerClosed
+	}
+	if err := s.admit(port, ip); err != nil {
+		return "", err
+	}
+	s.conns[conn] = true
+	s.metrics.Accepted++
+	s.serving.Add(1)
+	return ip, nil
+}
+
+// finish stops tracking a connection admitted by accept.
+func (s *Server) finish(conn net.Conn, ip string) {
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	s.release(ip)
+	s.mutex.Unlock()
+	s.serving.Done()
+}
+
+// BindAllTCP starts a Server for the given cache, network, and channel opener,
+// verifying peers which use the handshake with the key in the alias channel.
+// Records are found with the index of the cache if it is an IndexedCache, or else an index held in memory.
+// Legacy peers, which cannot prove their alias, are still added so existing nodes keep their peers.
+// Each option is applied to the Server before it is started, such as to set Unverified to refuse legacy peers,
+// or to set PeerStore, such as to a FilePeerStore in the node's data directory, to remember peers across restarts.
+func BindAllTCP(c bcgo.Cache, n *network.TCP, cb func(string) (bcgo.Channel, error), options ...func(*Server)) (*Server, error) {
+	return bindAll(c, n, cb, nil, options)
+}
+
+// BindAllTLS is like BindAllTCP, but with all ports secured by the given TLS configuration.
+func BindAllTLS(c bcgo.Cache, n *network.TCP, cb func(string) (bcgo.Channel, error), config *tls.Config, options ...func(*Server)) (*Server, error) {
+	return bindAll(c, n, cb, config, options)
+}
+
+func bindAll(c bcgo.Cache, n *network.TCP, cb func(string) (bcgo.Channel, error), config *tls.Config, options []func(*Server)) (*Server, error) {
+	if _, ok := c.(*IndexedCache); !ok {
+		c = NewIndexedCache(c, NewMemoryRecordIndex())
+	}
+	s := NewServer(c, n, cb)
+	s.Verify = ChannelAliasVerifier(aliasgo.OpenAliasChannel(), c, n)
+	s.Unverified = func(string, string) bool {
+		return true
+	}
+	s.TLSConfig = config
+	for _, o := range options {
+		o(s)
+	}
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// BindTCP listens on the given port and serves each connection with the handler,
+// applying the deadlines, connection limits, and rate limits set by NewServer.
+// It blocks until the listener fails, and returns the error.
+func BindTCP(port int, handler func(net.Conn)) error {
+	l, err := listenTCP(fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	s := NewServer(nil, nil, nil)
+	s.Listener = map[int]net.Listener{
+		port: l,
+	}
+	s.handlers = map[int]func(net.Conn){
+		port: handler,
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+	return <-s.Errors()
+}
+
+func listenTCP(a string) (net.Listener, error) {
+	address, err := net.ResolveTCPAddr("tcp", a)
+	if err != nil {
+		return nil, err
 	}
+	return net.ListenTCP("tcp", address)
 }
@@ -17,9 +17,231 @@
 package bcnetgo_test
 
 import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestBind(t *testing.T) {
 	// TODO
 }
+
+func makeServer(t *testing.T) *bcnetgo.Server {
+	t.Helper()
+	server := bcnetgo.NewServer(cache.NewMemory(10), makeNetwork(t), func(name string) (bcgo.Channel, error) {
+		return nil, errors.New("No such channel")
+	})
+	// Bind ephemeral ports on loopback
+	server.Address = make(map[int]string)
+	for _, port := range bcnetgo.Ports {
+		server.Address[port] = "127.0.0.1:0"
+	}
+	return server
+}
+
+func TestServer(t *testing.T) {
+	t.Run("Shutdown", func(t *testing.T) {
+		server := makeServer(t)
+		testinggo.AssertNoError(t, server.Start())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		testinggo.AssertNoError(t, server.Shutdown(ctx))
+
+		if _, err := net.Dial("tcp", server.Addr(network.PORT_GET_HEAD).String()); err == nil {
+			t.Fatal("Expected error")
+		}
+		if err := server.Start(); err != bcnetgo.ErrServerClosed {
+			t.Fatalf("Incorrect error; expected '%v', got '%v'", bcnetgo.ErrServerClosed, err)
+		}
+	})
+	t.Run("NotCreated", func(t *testing.T) {
+		server := &bcnetgo.Server{}
+		if err := server.Start(); err != bcnetgo.ErrServerNotCreated {
+			t.Fatalf("Incorrect error; expected '%v', got '%v'", bcnetgo.ErrServerNotCreated, err)
+		}
+		if err := server.Shutdown(context.Background()); err != bcnetgo.ErrServerNotCreated {
+			t.Fatalf("Incorrect error; expected '%v', got '%v'", bcnetgo.ErrServerNotCreated, err)
+		}
+	})
+	t.Run("ShutdownTimeout", func(t *testing.T) {
+		server := makeServer(t)
+		testinggo.AssertNoError(t, server.Start())
+
+		// Open a connection that never sends a request
+		client, err := net.Dial("tcp", server.Addr(network.PORT_GET_HEAD).String())
+		testinggo.AssertNoError(t, err)
+		defer client.Close()
+
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("Incorrect error; expected '%v', got '%v'", context.DeadlineExceeded, err)
+		}
+
+		// Expect connection to be closed by server
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := client.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+	t.Run("PortInUse", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		testinggo.AssertNoError(t, err)
+		defer l.Close()
+
+		server := makeServer(t)
+		server.Address[network.PORT_BROADCAST] = l.Addr().String()
+		if err := server.Start(); err == nil {
+			t.Fatal("Expected error")
+		}
+		if a := server.Addr(network.PORT_CONNECT); a != nil {
+			t.Fatalf("Expected no address, got '%s'", a)
+		}
+	})
+	t.Run("Listener", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		testinggo.AssertNoError(t, err)
+
+		server := makeServer(t)
+		server.Listener = map[int]net.Listener{
+			network.PORT_CONNECT: l,
+		}
+		testinggo.AssertNoError(t, server.Start())
+		defer server.Shutdown(context.Background())
+
+		expected := l.Addr().String()
+		got := server.Addr(network.PORT_CONNECT).String()
+		if expected != got {
+			t.Fatalf("Incorrect address; expected '%s', got '%s'", expected, got)
+		}
+	})
+	t.Run("AddressWithoutPort", func(t *testing.T) {
+		server := makeServer(t)
+		server.Address[network.PORT_GET_BLOCK] = "127.0.0.1"
+		testinggo.AssertNoError(t, server.Start())
+		defer server.Shutdown(context.Background())
+
+		expected := fmt.Sprintf("127.0.0.1:%d", network.PORT_GET_BLOCK)
+		got := server.Addr(network.PORT_GET_BLOCK).String()
+		if expected != got {
+			t.Fatalf("Incorrect address; expected '%s', got '%s'", expected, got)
+		}
+	})
+}
+
+func TestBindAllTCP(t *testing.T) {
+	// bind starts a server with BindAllTCP on ephemeral loopback ports, applying the given options
+	bind := func(t *testing.T, n *network.TCP, options ...func(*bcnetgo.Server)) *bcnetgo.Server {
+		t.Helper()
+		options = append([]func(*bcnetgo.Server){func(s *bcnetgo.Server) {
+			s.Address = make(map[int]string)
+			for _, port := range bcnetgo.Ports {
+				s.Address[port] = "127.0.0.1:0"
+			}
+		}}, options...)
+		server, err := bcnetgo.BindAllTCP(cache.NewMemory(10), n, nil, options...)
+		testinggo.AssertNoError(t, err)
+		return server
+	}
+	// legacy connects as a legacy peer with the given alias, and waits for the server to close the connection
+	legacy := func(t *testing.T, server *bcnetgo.Server, alias string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", server.Addr(network.PORT_CONNECT).String())
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(alias))
+		testinggo.AssertNoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.Read(make([]byte, 1))
+	}
+	t.Run("LegacyAllowed", func(t *testing.T) {
+		n := makeNetwork(t)
+		server := bind(t, n)
+		defer server.Shutdown(context.Background())
+		legacy(t, server, "Alice")
+		if !containsPeer(n, "Alice") {
+			t.Fatal("Expected peer to be added to network")
+		}
+	})
+	t.Run("PeerStore", func(t *testing.T) {
+		store := bcnetgo.NewMemoryPeerStore()
+		store.Update("Alice", func(r *bcnetgo.PeerRecord) {
+			r.Verified = true
+		})
+		n := makeNetwork(t)
+		server := bind(t, n, func(s *bcnetgo.Server) {
+			s.PeerStore = store
+		})
+		defer server.Shutdown(context.Background())
+		if !containsPeer(n, "Alice") {
+			t.Fatal("Expected stored peer to be added to network")
+		}
+	})
+	t.Run("LegacyRefused", func(t *testing.T) {
+		n := makeNetwork(t)
+		server := bind(t, n, func(s *bcnetgo.Server) {
+			s.Unverified = nil
+		})
+		defer server.Shutdown(context.Background())
+		legacy(t, server, "Alice")
+		if containsPeer(n, "Alice") {
+			t.Fatal("Expected peer to not be added to network")
+		}
+	})
+}
+
+func TestBindTCP(t *testing.T) {
+	t.Run("MaxConnectionsPerIP", func(t *testing.T) {
+		// Find a free port
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		testinggo.AssertNoError(t, err)
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		release := make(chan struct{})
+		defer close(release)
+		go bcnetgo.BindTCP(port, func(conn net.Conn) {
+			<-release
+			conn.Close()
+		})
+		address := fmt.Sprintf("127.0.0.1:%d", port)
+		dial := func() net.Conn {
+			t.Helper()
+			var conn net.Conn
+			var err error
+			for i := 0; i < 10; i++ {
+				if conn, err = net.Dial("tcp", address); err == nil {
+					return conn
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Fatal(err)
+			return nil
+		}
+		for i := 0; i < bcnetgo.DEFAULT_MAX_CONNECTIONS_PER_IP; i++ {
+			conn := dial()
+			defer conn.Close()
+		}
+
+		// Expect connection over the cap to be closed by server
+		conn := dial()
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Expected error")
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			t.Fatalf("Expected connection to be closed, got '%v'", err)
+		}
+	})
+}
@@ -9,5 +9,8 @@ require (
 	aletheiaware.com/financego v1.2.3
 	aletheiaware.com/netgo v1.2.0
 	aletheiaware.com/testinggo v1.2.2
+	github.com/golang/protobuf v1.5.2
 	github.com/stripe/stripe-go v70.15.0+incompatible
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	google.golang.org/protobuf v1.26.0
 )
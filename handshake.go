@@ -0,0 +1,257 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/aliasgo"
+	"aletheiaware.com/bcgo"
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	NONCE_SIZE = 32
+	// HANDSHAKE_DOMAIN separates handshake signatures from signatures made by the alias key for other purposes.
+	HANDSHAKE_DOMAIN = "bcnetgo handshake v1"
+	// ALIAS_REFRESH_INTERVAL is how often ChannelAliasVerifier loads the alias channel.
+	ALIAS_REFRESH_INTERVAL = time.Minute
+)
+
+// HandshakeMessage returns the message a peer signs to prove its alias to the server at the given address,
+// binding the signature to its purpose, the server, the alias, and the server's nonce.
+func HandshakeMessage(server, alias string, nonce []byte) []byte {
+	var message []byte
+	for _, s := range []string{HANDSHAKE_DOMAIN, server, alias} {
+		message = append(message, s...)
+		message = append(message, 0)
+	}
+	return append(message, nonce...)
+}
+
+// AliasVerifier returns an error unless signature is a valid signature of data by the key registered for alias.
+type AliasVerifier func(alias string, data, signature []byte) error
+
+// RSAAliasVerifier returns an AliasVerifier which checks SHA512 RSA-PSS signatures against the key returned by publicKey,
+// such as the key registered for the alias in the aliasgo alias channel, see ChannelAliasVerifier.
+func RSAAliasVerifier(publicKey func(string) (*rsa.PublicKey, error)) AliasVerifier {
+	return func(alias string, data, signature []byte) error {
+		key, err := publicKey(alias)
+		if err != nil {
+			return err
+		}
+		hash := sha512.Sum512(data)
+		return rsa.VerifyPSS(key, crypto.SHA512, hash[:], signature, nil)
+	}
+}
+
+// ChannelAliasVerifier returns an AliasVerifier which checks signatures against the keys registered in the given alias channel.
+// The channel's latest head is loaded at most once every ALIAS_REFRESH_INTERVAL, rather than by every peer which connects,
+// so aliases registered since are found once it next loads, and lookups are serialized as the channel is not safe for concurrent use.
+func ChannelAliasVerifier(aliases bcgo.Channel, cache bcgo.Cache, network bcgo.Network) AliasVerifier {
+	var mutex sync.Mutex
+	var loaded time.Time
+	return RSAAliasVerifier(func(alias string) (*rsa.PublicKey, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if time.Since(loaded) >= ALIAS_REFRESH_INTERVAL {
+			if err := aliases.Load(cache, network); err != nil {
+				log.Println(aliases.Name(), err)
+			}
+			loaded = time.Now()
+		}
+		return aliasgo.PublicKeyForAlias(aliases, cache, network, alias)
+	})
+}
+
+// RSASigner returns a function which signs the handshake message with SHA512 RSA-PSS.
+func RSASigner(key *rsa.PrivateKey) func([]byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		hash := sha512.Sum512(data)
+		return rsa.SignPSS(rand.Reader, key, crypto.SHA512, hash[:], nil)
+	}
+}
+
+// Connect performs the client side of the connect port handshake, using sign to answer the server's challenge,
+// and returns the protocol version and features agreed with the server.
+// An ErrStatus is returned if the server refuses the peer, such as when its signature could not be verified.
+func Connect(conn net.Conn, alias string, sign func([]byte) ([]byte, error)) (*Capabilities, error) {
+	capabilities, _, err := ConnectWith(conn, &ClientHello{
+		Alias: alias,
+	}, sign)
+	return capabilities, err
+}
+
+// ConnectWith is like Connect, but sends the given hello, such as to request the server's peers with WantPeers.
+// The supported versions and features are offered if the hello does not list any,
+// and the server is the remote address of the connection if the hello does not name one.
+func ConnectWith(conn net.Conn, hello *ClientHello, sign func([]byte) ([]byte, error)) (*Capabilities, []string, error) {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if len(hello.Versions) == 0 {
+		hello.Versions = SupportedVersions
+	}
+	if len(hello.Features) == 0 {
+		hello.Features = SupportedFeatures
+	}
+	if hello.Server == "" {
+		hello.Server = conn.RemoteAddr().String()
+	}
+	if err := WritePreamble(writer, PROTOCOL_VERSION); err != nil {
+		return nil, nil, err
+	}
+	if err := WriteDelimitedMessage(writer, hello); err != nil {
+		return nil, nil, err
+	}
+	reply := &ServerHello{}
+	if err := ReadDelimitedMessage(reader, reply, MAX_HANDSHAKE_SIZE); err != nil {
+		return nil, nil, err
+	}
+	if reply.Version == 0 {
+		return nil, nil, errors.New("No common protocol version")
+	}
+	capabilities := &Capabilities{
+		Version:  reply.Version,
+		Features: intersectFeatures(hello.Features, reply.Features),
+	}
+	if len(reply.Nonce) > 0 {
+		signature, err := sign(HandshakeMessage(hello.Server, hello.Alias, reply.Nonce))
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := WriteDelimitedMessage(writer, &ClientProof{
+			Signature: signature,
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+	result := &Response{}
+	if err := ReadDelimitedMessage(reader, result, MAX_HANDSHAKE_SIZE); err != nil {
+		return nil, nil, err
+	}
+	if result.Status != STATUS_OK {
+		return nil, nil, ErrStatus{
+			Status:  result.Status,
+			Message: result.Message,
+		}
+	}
+	if hello.WantPeers == 0 || !capabilities.Has(FEATURE_PEER_EXCHANGE) {
+		return capabilities, nil, nil
+	}
+	list := &PeerList{}
+	if err := ReadDelimitedMessage(reader, list, MAX_PEER_LIST_SIZE); err != nil {
+		return nil, nil, err
+	}
+	if uint64(len(list.Peers)) > hello.WantPeers {
+		return nil, nil, errors.New("Too many peers")
+	}
+	return capabilities, list.Peers, nil
+}
+
+// handshake performs the server side of the connect port handshake,
+// and returns the peer's hello, the capabilities agreed with it, and whether its alias was verified.
+func (s *Server) handshake(reader *bufio.Reader, writer *bufio.Writer, version uint64, local net.Addr) (*ClientHello, *Capabilities, bool, error) {
+	if !s.supportsVersion(version) {
+		return nil, nil, false, fmt.Errorf("Unsupported protocol version: %d", version)
+	}
+	hello := &ClientHello{}
+	if err := ReadDelimitedMessage(reader, hello, MAX_HANDSHAKE_SIZE); err != nil {
+		return nil, nil, false, err
+	}
+	if len(hello.Alias) > aliasgo.MAX_ALIAS_LENGTH {
+		return nil, nil, false, errors.New("Alias too long")
+	}
+	offered := hello.Versions
+	if len(offered) == 0 {
+		offered = []uint64{version}
+	}
+	negotiated, ok := s.negotiateVersion(offered)
+	if !ok {
+		WriteDelimitedMessage(writer, &ServerHello{})
+		return nil, nil, false, errors.New("No common protocol version")
+	}
+	features := s.features()
+	capabilities := &Capabilities{
+		Version:  negotiated,
+		Features: intersectFeatures(hello.Features, features),
+	}
+	reply := &ServerHello{
+		Version:  negotiated,
+		Features: features,
+	}
+	if s.Verify == nil {
+		// Unable to authenticate, reply without a challenge
+		return hello, capabilities, false, WriteDelimitedMessage(writer, reply)
+	}
+	reply.Nonce = make([]byte, NONCE_SIZE)
+	if _, err := rand.Read(reply.Nonce); err != nil {
+		return nil, nil, false, err
+	}
+	if err := WriteDelimitedMessage(writer, reply); err != nil {
+		return nil, nil, false, err
+	}
+	proof := &ClientProof{}
+	if err := ReadDelimitedMessage(reader, proof, MAX_HANDSHAKE_SIZE); err != nil {
+		return nil, nil, false, err
+	}
+	if !s.isIdentity(hello.Server, local) {
+		return nil, nil, false, fmt.Errorf("Wrong server: %s", hello.Server)
+	}
+	if err := s.Verify(hello.Alias, HandshakeMessage(hello.Server, hello.Alias, reply.Nonce), proof.Signature); err != nil {
+		return nil, nil, false, err
+	}
+	return hello, capabilities, true, nil
+}
+
+func (s *Server) allowUnverified(address, peer string) bool {
+	if s.Unverified != nil {
+		return s.Unverified(address, peer)
+	}
+	return s.Verify == nil
+}
+
+// isIdentity returns true if the server named by a client is one of the server's Identities,
+// or the address the connection was accepted on, comparing only hosts if either has no port.
+func (s *Server) isIdentity(server string, local net.Addr) bool {
+	identities := s.Identities
+	if local != nil {
+		identities = append([]string{local.String()}, identities...)
+	}
+	for _, i := range identities {
+		if i == server || hostOf(i) == server || i == hostOf(server) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOf returns the host of an address, or the address if it has no port.
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/aliasgo"
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+func containsPeer(network *network.TCP, peer string) bool {
+	for _, p := range network.Peers() {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// countingCache counts the heads read from the cache.
+type countingCache struct {
+	bcgo.Cache
+	mutex sync.Mutex
+	heads int
+}
+
+func (c *countingCache) Head(channel string) (*bcgo.Reference, error) {
+	c.mutex.Lock()
+	c.heads++
+	c.mutex.Unlock()
+	return c.Cache.Head(channel)
+}
+
+func (c *countingCache) Heads() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.heads
+}
+
+func TestHandshake(t *testing.T) {
+	aliceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	testinggo.AssertNoError(t, err)
+	bobKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	testinggo.AssertNoError(t, err)
+	verifier := bcnetgo.RSAAliasVerifier(func(alias string) (*rsa.PublicKey, error) {
+		if alias == "Alice" {
+			return &aliceKey.PublicKey, nil
+		}
+		return nil, errors.New("No such alias")
+	})
+
+	// connect runs the server handler against the given client and waits for it to finish
+	connect := func(t *testing.T, server *bcnetgo.Server, client func(net.Conn) error) {
+		t.Helper()
+		s, c := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			server.ConnectPortTCPHandler(s)
+			close(done)
+		}()
+		client(c)
+		c.Close()
+		<-done
+	}
+	legacy := func(alias string) func(net.Conn) error {
+		return func(conn net.Conn) error {
+			writer := bufio.NewWriter(conn)
+			writer.Write([]byte(alias))
+			return writer.Flush()
+		}
+	}
+
+	t.Run("Verified", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Verify = verifier
+		connect(t, server, func(conn net.Conn) error {
+			_, err := bcnetgo.Connect(conn, "Alice", bcnetgo.RSASigner(aliceKey))
+			testinggo.AssertNoError(t, err)
+			return err
+		})
+		if !containsPeer(network, "Alice") {
+			t.Fatal("Expected peer to be added to network")
+		}
+	})
+	t.Run("WrongKey", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Verify = verifier
+		connect(t, server, func(conn net.Conn) error {
+			_, err := bcnetgo.Connect(conn, "Alice", bcnetgo.RSASigner(bobKey))
+			expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+			return err
+		})
+		if containsPeer(network, "Alice") {
+			t.Fatal("Expected peer to not be added to network")
+		}
+	})
+	t.Run("WrongServer", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Verify = verifier
+		connect(t, server, func(conn net.Conn) error {
+			// Signature made for another server must not be accepted
+			_, _, err := bcnetgo.ConnectWith(conn, &bcnetgo.ClientHello{
+				Alias:  "Alice",
+				Server: "example.com",
+			}, bcnetgo.RSASigner(aliceKey))
+			expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+			return err
+		})
+		if containsPeer(network, "Alice") {
+			t.Fatal("Expected peer to not be added to network")
+		}
+	})
+	t.Run("Identity", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Verify = verifier
+		server.Identities = []string{"example.com"}
+		connect(t, server, func(conn net.Conn) error {
+			_, _, err := bcnetgo.ConnectWith(conn, &bcnetgo.ClientHello{
+				Alias:  "Alice",
+				Server: "example.com:22232",
+			}, bcnetgo.RSASigner(aliceKey))
+			testinggo.AssertNoError(t, err)
+			return err
+		})
+		if !containsPeer(network, "Alice") {
+			t.Fatal("Expected peer to be added to network")
+		}
+	})
+	t.Run("UnknownAlias", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Verify = verifier
+		server.Unverified = func(address, peer string) bool {
+			return true
+		}
+		connect(t, server, func(conn net.Conn) error {
+			_, err := bcnetgo.Connect(conn, "Bob", bcnetgo.RSASigner(bobKey))
+			expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+			return err
+		})
+		if containsPeer(network, "Bob") {
+			t.Fatal("Expected peer to not be added to network")
+		}
+	})
+	t.Run("AliasChannelUnregistered", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Verify = bcnetgo.ChannelAliasVerifier(aliasgo.OpenAliasChannel(), cache.NewMemory(10), network)
+		connect(t, server, func(conn net.Conn) error {
+			_, err := bcnetgo.Connect(conn, "Alice", bcnetgo.RSASigner(aliceKey))
+			expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+			return err
+		})
+		if containsPeer(network, "Alice") {
+			t.Fatal("Expected peer to not be added to network")
+		}
+	})
+	t.Run("AliasChannelLoadedOnce", func(t *testing.T) {
+		network := makeNetwork(t)
+		c := &countingCache{
+			Cache: cache.NewMemory(10),
+		}
+		testinggo.AssertNoError(t, c.PutHead(aliasgo.ALIAS, &bcgo.Reference{
+			ChannelName: aliasgo.ALIAS,
+			BlockHash:   []byte("head"),
+		}))
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Verify = bcnetgo.ChannelAliasVerifier(aliasgo.OpenAliasChannel(), c, network)
+		// Connect concurrently, so any unsynchronized use of the alias channel is caught by the race detector
+		errs := make(chan error, 4)
+		for i := 0; i < cap(errs); i++ {
+			go func() {
+				s, c := net.Pipe()
+				go server.ConnectPortTCPHandler(s)
+				defer c.Close()
+				_, err := bcnetgo.Connect(c, "Alice", bcnetgo.RSASigner(aliceKey))
+				errs <- err
+			}()
+		}
+		for i := 0; i < cap(errs); i++ {
+			expectStatus(t, bcnetgo.STATUS_FORBIDDEN, <-errs)
+		}
+		if got := c.Heads(); got != 1 {
+			t.Fatalf("Incorrect head reads; expected '%d', got '%d'", 1, got)
+		}
+	})
+	t.Run("LegacyRejected", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Verify = verifier
+		connect(t, server, legacy("Alice"))
+		if containsPeer(network, "Alice") {
+			t.Fatal("Expected peer to not be added to network")
+		}
+	})
+	t.Run("LegacyAllowed", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Verify = verifier
+		server.Unverified = func(address, peer string) bool {
+			return peer == "Charlie"
+		}
+		connect(t, server, legacy("Charlie"))
+		if !containsPeer(network, "Charlie") {
+			t.Fatal("Expected peer to be added to network")
+		}
+	})
+	t.Run("Disallowed", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		server.Allowed = func(address, peer string) bool {
+			return false
+		}
+		connect(t, server, func(conn net.Conn) error {
+			_, err := bcnetgo.Connect(conn, "Alice", nil)
+			expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+			return err
+		})
+		if containsPeer(network, "Alice") {
+			t.Fatal("Expected peer to not be added to network")
+		}
+	})
+	t.Run("NoVerifier", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		connect(t, server, func(conn net.Conn) error {
+			_, err := bcnetgo.Connect(conn, "Alice", func([]byte) ([]byte, error) {
+				t.Fatal("Expected no challenge")
+				return nil, nil
+			})
+			testinggo.AssertNoError(t, err)
+			return err
+		})
+		if !containsPeer(network, "Alice") {
+			t.Fatal("Expected peer to be added to network")
+		}
+	})
+}
@@ -46,83 +46,50 @@ func BlockHandler(cache bcgo.Cache, template *template.Template) func(w http.Res
 					log.Println(err)
 					return
 				}
-				type TemplateReference struct {
-					Timestamp  string
-					Channel    string
-					BlockHash  string
-					RecordHash string
-				}
-				type TemplateAccess struct {
-					Alias               string
-					SecretKey           string
-					EncryptionAlgorithm string
+				if err := template.Execute(w, blockTemplateData(hash, block)); err != nil {
+					log.Println(err)
+					return
 				}
-				type TemplateEntry struct {
-					Hash                 string
-					Timestamp            string
-					Creator              string
-					Access               []TemplateAccess
-					Payload              string
-					CompressionAlgorithm string
-					EncryptionAlgorithm  string
-					Signature            string
-					SignatureAlgorithm   string
-					Reference            []TemplateReference
-					Meta                 map[string]string
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
+
+func RecordHandler(cache bcgo.Cache, index RecordIndex, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			channel := netgo.QueryParameter(r.URL.Query(), "channel")
+			record := netgo.QueryParameter(r.URL.Query(), "record")
+			log.Println("Channel", channel)
+			log.Println("Record", record)
+
+			if len(channel) > 0 && len(record) > 0 {
+				recordBytes, err := base64.RawURLEncoding.DecodeString(record)
+				if err != nil {
+					log.Println(err)
+					return
 				}
-				entries := make([]TemplateEntry, 0)
-				for _, e := range block.Entry {
-					accesses := make([]TemplateAccess, 0)
-					for _, a := range e.Record.Access {
-						accesses = append(accesses, TemplateAccess{
-							Alias:               a.Alias,
-							SecretKey:           base64.RawURLEncoding.EncodeToString(a.SecretKey),
-							EncryptionAlgorithm: a.EncryptionAlgorithm.String(),
-						})
-					}
-					references := make([]TemplateReference, 0)
-					for _, r := range e.Record.Reference {
-						references = append(references, TemplateReference{
-							Timestamp:  bcgo.TimestampToString(r.Timestamp),
-							Channel:    r.ChannelName,
-							BlockHash:  base64.RawURLEncoding.EncodeToString(r.BlockHash),
-							RecordHash: base64.RawURLEncoding.EncodeToString(r.RecordHash),
-						})
-					}
-					entries = append(entries, TemplateEntry{
-						Hash:                 base64.RawURLEncoding.EncodeToString(e.RecordHash),
-						Timestamp:            bcgo.TimestampToString(e.Record.Timestamp),
-						Creator:              e.Record.Creator,
-						Access:               accesses,
-						Payload:              base64.RawURLEncoding.EncodeToString(e.Record.Payload), // TODO allow override for custom rendering
-						CompressionAlgorithm: e.Record.CompressionAlgorithm.String(),
-						EncryptionAlgorithm:  e.Record.EncryptionAlgorithm.String(),
-						Signature:            base64.RawURLEncoding.EncodeToString(e.Record.Signature),
-						SignatureAlgorithm:   e.Record.SignatureAlgorithm.String(),
-						Reference:            references,
-						Meta:                 e.Record.Meta,
-					})
+				// Lookup block containing record
+				hashBytes, err := index.BlockHash(channel, recordBytes)
+				if err != nil {
+					log.Println(err)
+					w.WriteHeader(http.StatusNotFound)
+					return
 				}
-				data := struct {
-					Hash      string
-					Timestamp string
-					Channel   string
-					Length    string
-					Previous  string
-					Miner     string
-					Nonce     string
-					Entry     []TemplateEntry
-				}{
-					Hash:      hash,
-					Timestamp: bcgo.TimestampToString(block.Timestamp),
-					Channel:   block.ChannelName,
-					Length:    fmt.Sprintf("%d", block.Length),
-					Previous:  base64.RawURLEncoding.EncodeToString(block.Previous),
-					Miner:     block.Miner,
-					Nonce:     fmt.Sprintf("%d", block.Nonce),
-					Entry:     entries,
+				// Read block
+				block, err := cache.Block(hashBytes)
+				if err != nil {
+					log.Println(err)
+					return
 				}
-				if err := template.Execute(w, data); err != nil {
+				hash := base64.RawURLEncoding.EncodeToString(hashBytes)
+				if err := template.Execute(w, blockTemplateData(hash, block)); err != nil {
 					log.Println(err)
 					return
 				}
@@ -135,6 +102,86 @@ func BlockHandler(cache bcgo.Cache, template *template.Template) func(w http.Res
 	}
 }
 
+// blockTemplateData returns the data used to render a block with a template.
+func blockTemplateData(hash string, block *bcgo.Block) interface{} {
+	type TemplateReference struct {
+		Timestamp  string
+		Channel    string
+		BlockHash  string
+		RecordHash string
+	}
+	type TemplateAccess struct {
+		Alias               string
+		SecretKey           string
+		EncryptionAlgorithm string
+	}
+	type TemplateEntry struct {
+		Hash                 string
+		Timestamp            string
+		Creator              string
+		Access               []TemplateAccess
+		Payload              string
+		CompressionAlgorithm string
+		EncryptionAlgorithm  string
+		Signature            string
+		SignatureAlgorithm   string
+		Reference            []TemplateReference
+		Meta                 map[string]string
+	}
+	entries := make([]TemplateEntry, 0)
+	for _, e := range block.Entry {
+		accesses := make([]TemplateAccess, 0)
+		for _, a := range e.Record.Access {
+			accesses = append(accesses, TemplateAccess{
+				Alias:               a.Alias,
+				SecretKey:           base64.RawURLEncoding.EncodeToString(a.SecretKey),
+				EncryptionAlgorithm: a.EncryptionAlgorithm.String(),
+			})
+		}
+		references := make([]TemplateReference, 0)
+		for _, r := range e.Record.Reference {
+			references = append(references, TemplateReference{
+				Timestamp:  bcgo.TimestampToString(r.Timestamp),
+				Channel:    r.ChannelName,
+				BlockHash:  base64.RawURLEncoding.EncodeToString(r.BlockHash),
+				RecordHash: base64.RawURLEncoding.EncodeToString(r.RecordHash),
+			})
+		}
+		entries = append(entries, TemplateEntry{
+			Hash:                 base64.RawURLEncoding.EncodeToString(e.RecordHash),
+			Timestamp:            bcgo.TimestampToString(e.Record.Timestamp),
+			Creator:              e.Record.Creator,
+			Access:               accesses,
+			Payload:              base64.RawURLEncoding.EncodeToString(e.Record.Payload), // TODO allow override for custom rendering
+			CompressionAlgorithm: e.Record.CompressionAlgorithm.String(),
+			EncryptionAlgorithm:  e.Record.EncryptionAlgorithm.String(),
+			Signature:            base64.RawURLEncoding.EncodeToString(e.Record.Signature),
+			SignatureAlgorithm:   e.Record.SignatureAlgorithm.String(),
+			Reference:            references,
+			Meta:                 e.Record.Meta,
+		})
+	}
+	return struct {
+		Hash      string
+		Timestamp string
+		Channel   string
+		Length    string
+		Previous  string
+		Miner     string
+		Nonce     string
+		Entry     []TemplateEntry
+	}{
+		Hash:      hash,
+		Timestamp: bcgo.TimestampToString(block.Timestamp),
+		Channel:   block.ChannelName,
+		Length:    fmt.Sprintf("%d", block.Length),
+		Previous:  base64.RawURLEncoding.EncodeToString(block.Previous),
+		Miner:     block.Miner,
+		Nonce:     fmt.Sprintf("%d", block.Nonce),
+		Entry:     entries,
+	}
+}
+
 func ChannelHandler(cache bcgo.Cache, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
@@ -17,9 +17,10 @@
 package bcnetgo_test
 
 import (
-	// "aletheiaware.com/bcnetgo"
+	"aletheiaware.com/bcnetgo"
+	"html/template"
 	"net/http"
-	// "net/http/httptest"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -37,6 +38,35 @@ func makeGetBlockRequest(channel, hash string) *http.Request {
 	return request
 }
 
+func TestRecordHandler(t *testing.T) {
+	cache, _, _ := makeCache(t)
+	index := bcnetgo.NewMemoryRecordIndex()
+	if err := bcnetgo.RebuildRecordIndex(index, cache, "Test"); err != nil {
+		t.Fatal(err)
+	}
+	handler := bcnetgo.RecordHandler(cache, index, template.Must(template.New("record").Parse("{{.Channel}} {{.Length}}")))
+	t.Run("RecordExists", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		// "UmVjb3JkMTIz" is "Record123" in base64
+		handler(recorder, makeGetRecordRequest("Test", "UmVjb3JkMTIz"))
+		if got := recorder.Body.String(); got != "Test 1" {
+			t.Fatalf("Incorrect body; expected '%s', got '%s'", "Test 1", got)
+		}
+	})
+	t.Run("RecordNotExists", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		handler(recorder, makeGetRecordRequest("Test", "Rm9vQmFy"))
+		if recorder.Code != http.StatusNotFound {
+			t.Fatalf("Incorrect status; expected '%d', got '%d'", http.StatusNotFound, recorder.Code)
+		}
+	})
+}
+
+func makeGetRecordRequest(channel, record string) *http.Request {
+	request, _ := http.NewRequest(http.MethodGet, "/record?channel="+channel+"&record="+record, nil)
+	return request
+}
+
 func TestChannelHandler(t *testing.T) {
 	t.Run("Exists", func(t *testing.T) {
 		// TODO
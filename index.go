@@ -0,0 +1,282 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/bcgo"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RecordIndex maps the hash of a record to the hash of the block containing it.
+type RecordIndex interface {
+	BlockHash(channel string, record []byte) ([]byte, error)
+	PutRecord(channel string, record, block []byte) error
+	RemoveRecord(channel string, record []byte) error
+}
+
+type ErrRecordNotIndexed struct {
+	Channel string
+	Hash    []byte
+}
+
+func (e ErrRecordNotIndexed) Error() string {
+	return fmt.Sprintf("Record not indexed %s %s", e.Channel, base64.RawURLEncoding.EncodeToString(e.Hash))
+}
+
+type MemoryRecordIndex struct {
+	mutex  sync.RWMutex
+	hashes map[string][]byte
+}
+
+func NewMemoryRecordIndex() *MemoryRecordIndex {
+	return &MemoryRecordIndex{
+		hashes: make(map[string][]byte),
+	}
+}
+
+func (i *MemoryRecordIndex) BlockHash(channel string, record []byte) ([]byte, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	hash, ok := i.hashes[recordKey(channel, record)]
+	if !ok {
+		return nil, ErrRecordNotIndexed{
+			Channel: channel,
+			Hash:    record,
+		}
+	}
+	return hash, nil
+}
+
+func (i *MemoryRecordIndex) PutRecord(channel string, record, block []byte) error {
+	i.mutex.Lock()
+	i.hashes[recordKey(channel, record)] = block
+	i.mutex.Unlock()
+	return nil
+}
+
+func (i *MemoryRecordIndex) RemoveRecord(channel string, record []byte) error {
+	i.mutex.Lock()
+	delete(i.hashes, recordKey(channel, record))
+	i.mutex.Unlock()
+	return nil
+}
+
+func recordKey(channel string, record []byte) string {
+	return channel + "/" + base64.RawURLEncoding.EncodeToString(record)
+}
+
+// FileRecordIndex stores the index on disk so it survives restarts, with one file per record holding the block hash.
+type FileRecordIndex struct {
+	Directory string
+}
+
+func NewFileRecordIndex(directory string) (*FileRecordIndex, error) {
+	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &FileRecordIndex{
+		Directory: directory,
+	}, nil
+}
+
+func (i *FileRecordIndex) BlockHash(channel string, record []byte) ([]byte, error) {
+	hash, err := ioutil.ReadFile(i.path(channel, record))
+	if os.IsNotExist(err) {
+		return nil, ErrRecordNotIndexed{
+			Channel: channel,
+			Hash:    record,
+		}
+	}
+	return hash, err
+}
+
+func (i *FileRecordIndex) PutRecord(channel string, record, block []byte) error {
+	path := i.path(channel, record)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, block, 0600)
+}
+
+func (i *FileRecordIndex) RemoveRecord(channel string, record []byte) error {
+	if err := os.Remove(i.path(channel, record)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (i *FileRecordIndex) path(channel string, record []byte) string {
+	return filepath.Join(i.Directory, base64.RawURLEncoding.EncodeToString([]byte(channel)), base64.RawURLEncoding.EncodeToString(record))
+}
+
+// IndexedCache wraps a cache and indexes the records of the blocks on each channel's chain as its head moves,
+// so records in blocks which are not, or are no longer, on the chain are not found.
+// It is also a RecordIndex, which first catches the index up with any head written to the underlying cache directly,
+// indexing the whole chain the first time a channel is looked up.
+type IndexedCache struct {
+	bcgo.Cache
+	Index RecordIndex
+
+	mutex sync.Mutex
+	heads map[string][]byte
+}
+
+func NewIndexedCache(cache bcgo.Cache, index RecordIndex) *IndexedCache {
+	return &IndexedCache{
+		Cache: cache,
+		Index: index,
+		heads: make(map[string][]byte),
+	}
+}
+
+// PutHead writes the head to the underlying cache, then indexes the chain.
+// Once the head is written it is not undone, so an indexing error is logged, and indexing is retried by the next lookup.
+func (c *IndexedCache) PutHead(channel string, reference *bcgo.Reference) error {
+	if err := c.Cache.PutHead(channel, reference); err != nil {
+		return err
+	}
+	if err := c.update(channel, reference.BlockHash); err != nil {
+		log.Println(channel, err)
+	}
+	return nil
+}
+
+func (c *IndexedCache) BlockContainingRecord(channel string, record []byte) (*bcgo.Block, error) {
+	hash, err := c.BlockHash(channel, record)
+	if err != nil {
+		return nil, err
+	}
+	return c.Cache.Block(hash)
+}
+
+func (c *IndexedCache) BlockHash(channel string, record []byte) ([]byte, error) {
+	if reference, err := c.Cache.Head(channel); err == nil {
+		if err := c.update(channel, reference.BlockHash); err != nil {
+			return nil, err
+		}
+	}
+	return c.Index.BlockHash(channel, record)
+}
+
+func (c *IndexedCache) PutRecord(channel string, record, block []byte) error {
+	return c.Index.PutRecord(channel, record, block)
+}
+
+func (c *IndexedCache) RemoveRecord(channel string, record []byte) error {
+	return c.Index.RemoveRecord(channel, record)
+}
+
+// update moves the index of the channel from the head it was last indexed at to the given head.
+func (c *IndexedCache) update(channel string, head []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.heads == nil {
+		c.heads = make(map[string][]byte)
+	}
+	if err := reindex(c.Index, c.Cache, c.heads[channel], head); err != nil {
+		return err
+	}
+	c.heads[channel] = head
+	return nil
+}
+
+// recordIndex returns the index of Cache if it is an IndexedCache, which is kept up to date with the cache, or else Index.
+func (s *Server) recordIndex() RecordIndex {
+	if c, ok := s.Cache.(*IndexedCache); ok {
+		return c
+	}
+	return s.Index
+}
+
+// RebuildRecordIndex indexes every block in the channel, from the head held in the cache back to the genesis block.
+func RebuildRecordIndex(index RecordIndex, cache bcgo.Cache, channel string) error {
+	reference, err := cache.Head(channel)
+	if err != nil {
+		return err
+	}
+	return bcgo.Iterate(channel, reference.BlockHash, nil, cache, nil, func(h []byte, b *bcgo.Block) error {
+		return indexBlock(index, h, b)
+	})
+}
+
+// reindex moves the index from the chain ending at the previous head to the chain ending at the current head,
+// removing the records of blocks only on the previous chain, and then indexing the blocks only on the current chain.
+func reindex(index RecordIndex, cache bcgo.Cache, previous, current []byte) error {
+	block := func(hash []byte) (*bcgo.Block, error) {
+		if len(hash) == 0 {
+			return nil, nil
+		}
+		return cache.Block(hash)
+	}
+	p, err := block(previous)
+	if err != nil {
+		return err
+	}
+	c, err := block(current)
+	if err != nil {
+		return err
+	}
+	var removed []*bcgo.Block
+	var added [][]byte
+	var blocks []*bcgo.Block
+	// Walk back the longer chain until both reach their common ancestor, or their genesis blocks
+	for !bytes.Equal(previous, current) && (p != nil || c != nil) {
+		if c != nil && (p == nil || c.Length >= p.Length) {
+			added = append(added, current)
+			blocks = append(blocks, c)
+			current = c.Previous
+			if c, err = block(current); err != nil {
+				return err
+			}
+		} else {
+			removed = append(removed, p)
+			previous = p.Previous
+			if p, err = block(previous); err != nil {
+				return err
+			}
+		}
+	}
+	for _, b := range removed {
+		for _, e := range b.Entry {
+			if err := index.RemoveRecord(b.ChannelName, e.RecordHash); err != nil {
+				return err
+			}
+		}
+	}
+	for i, h := range added {
+		if err := indexBlock(index, h, blocks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexBlock(index RecordIndex, hash []byte, block *bcgo.Block) error {
+	for _, e := range block.Entry {
+		if err := index.PutRecord(block.ChannelName, e.RecordHash, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/cryptogo"
+	"aletheiaware.com/testinggo"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testRecordIndex(t *testing.T, index bcnetgo.RecordIndex) {
+	t.Helper()
+	if _, err := index.BlockHash("Test", []byte("Record123")); err == nil {
+		t.Fatal("Expected error")
+	} else if _, ok := err.(bcnetgo.ErrRecordNotIndexed); !ok {
+		t.Fatalf("Incorrect error; expected ErrRecordNotIndexed, got '%v'", err)
+	}
+	testinggo.AssertNoError(t, index.PutRecord("Test", []byte("Record123"), []byte("Block123")))
+	hash, err := index.BlockHash("Test", []byte("Record123"))
+	testinggo.AssertNoError(t, err)
+	if !bytes.Equal(hash, []byte("Block123")) {
+		t.Fatalf("Incorrect hash; expected '%s', got '%s'", "Block123", hash)
+	}
+	if _, err := index.BlockHash("Other", []byte("Record123")); err == nil {
+		t.Fatal("Expected error")
+	}
+	testinggo.AssertNoError(t, index.RemoveRecord("Test", []byte("Record456")))
+}
+
+func TestRecordIndex(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		testRecordIndex(t, bcnetgo.NewMemoryRecordIndex())
+	})
+	t.Run("File", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "index")
+		testinggo.AssertNoError(t, err)
+		defer os.RemoveAll(dir)
+		index, err := bcnetgo.NewFileRecordIndex(dir)
+		testinggo.AssertNoError(t, err)
+		testRecordIndex(t, index)
+
+		// Index persists
+		index, err = bcnetgo.NewFileRecordIndex(dir)
+		testinggo.AssertNoError(t, err)
+		_, err = index.BlockHash("Test", []byte("Record123"))
+		testinggo.AssertNoError(t, err)
+	})
+}
+
+// failingIndex fails to put records until it has failed once.
+type failingIndex struct {
+	bcnetgo.RecordIndex
+	failed bool
+}
+
+func (i *failingIndex) PutRecord(channel string, record, block []byte) error {
+	if !i.failed {
+		i.failed = true
+		return errors.New("Disk full")
+	}
+	return i.RecordIndex.PutRecord(channel, record, block)
+}
+
+func TestIndexedCache(t *testing.T) {
+	t.Run("PutHead", func(t *testing.T) {
+		_, hash, block := makeCache(t)
+		index := bcnetgo.NewMemoryRecordIndex()
+		cache := bcnetgo.NewIndexedCache(cache.NewMemory(10), index)
+		testinggo.AssertNoError(t, cache.PutBlock(hash, block))
+
+		// Blocks are not indexed until they are on the chain
+		if _, err := index.BlockHash("Test", []byte("Record123")); err == nil {
+			t.Fatal("Expected error")
+		}
+
+		testinggo.AssertNoError(t, cache.PutHead("Test", &bcgo.Reference{
+			Timestamp:   block.Timestamp,
+			ChannelName: "Test",
+			BlockHash:   hash,
+		}))
+		got, err := index.BlockHash("Test", []byte("Record123"))
+		testinggo.AssertNoError(t, err)
+		if !bytes.Equal(got, hash) {
+			t.Fatal("Incorrect block hash")
+		}
+		b, err := cache.BlockContainingRecord("Test", []byte("Record123"))
+		testinggo.AssertNoError(t, err)
+		if b.Length != block.Length {
+			t.Fatal("Incorrect block")
+		}
+	})
+	t.Run("Fork", func(t *testing.T) {
+		index := bcnetgo.NewMemoryRecordIndex()
+		cache := bcnetgo.NewIndexedCache(cache.NewMemory(10), index)
+		put := func(length uint64, previous []byte, record string) []byte {
+			t.Helper()
+			block := &bcgo.Block{
+				Timestamp:   length,
+				ChannelName: "Test",
+				Length:      length,
+				Previous:    previous,
+				Entry: []*bcgo.BlockEntry{
+					{
+						RecordHash: []byte(record),
+						Record:     &bcgo.Record{},
+					},
+				},
+			}
+			hash, err := cryptogo.HashProtobuf(block)
+			testinggo.AssertNoError(t, err)
+			testinggo.AssertNoError(t, cache.PutBlock(hash, block))
+			return hash
+		}
+		head := func(hash []byte) {
+			t.Helper()
+			testinggo.AssertNoError(t, cache.PutHead("Test", &bcgo.Reference{
+				ChannelName: "Test",
+				BlockHash:   hash,
+			}))
+		}
+		genesis := put(1, nil, "Genesis")
+		orphan := put(2, genesis, "Orphan")
+		head(orphan)
+		main := put(2, genesis, "Main")
+		head(put(3, main, "Head"))
+
+		if _, err := index.BlockHash("Test", []byte("Orphan")); err == nil {
+			t.Fatal("Expected record of replaced fork to be removed")
+		}
+		for record, expected := range map[string][]byte{
+			"Genesis": genesis,
+			"Main":    main,
+		} {
+			got, err := index.BlockHash("Test", []byte(record))
+			testinggo.AssertNoError(t, err)
+			if !bytes.Equal(got, expected) {
+				t.Fatalf("Incorrect block hash for %s", record)
+			}
+		}
+	})
+	t.Run("CatchUp", func(t *testing.T) {
+		underlying, hash, _ := makeCache(t)
+		cache := bcnetgo.NewIndexedCache(underlying, bcnetgo.NewMemoryRecordIndex())
+		// Head was written to the underlying cache directly
+		got, err := cache.BlockHash("Test", []byte("Record123"))
+		testinggo.AssertNoError(t, err)
+		if !bytes.Equal(got, hash) {
+			t.Fatal("Incorrect block hash")
+		}
+	})
+	t.Run("IndexFailure", func(t *testing.T) {
+		_, hash, block := makeCache(t)
+		index := &failingIndex{
+			RecordIndex: bcnetgo.NewMemoryRecordIndex(),
+		}
+		underlying := cache.NewMemory(10)
+		cache := bcnetgo.NewIndexedCache(underlying, index)
+		testinggo.AssertNoError(t, cache.PutBlock(hash, block))
+		// Head has been written, so the indexing error is not returned
+		testinggo.AssertNoError(t, cache.PutHead("Test", &bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   hash,
+		}))
+		reference, err := underlying.Head("Test")
+		testinggo.AssertNoError(t, err)
+		if !bytes.Equal(reference.BlockHash, hash) {
+			t.Fatal("Incorrect head")
+		}
+
+		// Indexing is retried by the next lookup
+		got, err := cache.BlockHash("Test", []byte("Record123"))
+		testinggo.AssertNoError(t, err)
+		if !bytes.Equal(got, hash) {
+			t.Fatal("Incorrect block hash")
+		}
+	})
+	t.Run("Rebuild", func(t *testing.T) {
+		cache, hash, _ := makeCache(t)
+		index := bcnetgo.NewMemoryRecordIndex()
+		testinggo.AssertNoError(t, bcnetgo.RebuildRecordIndex(index, cache, "Test"))
+		got, err := index.BlockHash("Test", []byte("Record123"))
+		testinggo.AssertNoError(t, err)
+		if !bytes.Equal(got, hash) {
+			t.Fatal("Incorrect block hash")
+		}
+	})
+}
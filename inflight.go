@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"encoding/base64"
+	"sync"
+)
+
+// flight is a broadcast block being back-filled and updated, which other broadcasts of the same block wait on.
+type flight struct {
+	done     chan struct{}
+	response *Response
+}
+
+func flightKey(channel string, hash []byte) string {
+	return channel + "/" + base64.RawURLEncoding.EncodeToString(hash)
+}
+
+// coalesce calls fn unless the same block is already in flight, in which case it waits and returns the same response.
+// If the block in flight fails before producing a response, such as when back-fill fails, the waiters try again.
+// The returned bool is true if the caller's fn produced the response.
+func (s *Server) coalesce(channel string, hash []byte, fn func() (*Response, error)) (*Response, bool, error) {
+	key := flightKey(channel, hash)
+	for {
+		s.mutex.Lock()
+		f, ok := s.flights[key]
+		if !ok {
+			f = &flight{
+				done: make(chan struct{}),
+			}
+			s.flights[key] = f
+		}
+		s.mutex.Unlock()
+		if ok {
+			<-f.done
+			if f.response != nil {
+				response := *f.response
+				return &response, false, nil
+			}
+			continue
+		}
+		response, err := fn()
+		s.mutex.Lock()
+		delete(s.flights, key)
+		s.mutex.Unlock()
+		if err == nil {
+			// Waiters get their own copy, as the caller may modify the response
+			r := *response
+			f.response = &r
+		}
+		close(f.done)
+		return response, true, err
+	}
+}
+
+// awaitFlight waits for the block to land if it is in flight, and returns true if it was.
+func (s *Server) awaitFlight(channel string, hash []byte) bool {
+	s.mutex.Lock()
+	f, ok := s.flights[flightKey(channel, hash)]
+	s.mutex.Unlock()
+	if ok {
+		<-f.done
+	}
+	return ok
+}
+
+// channelLock returns the mutex serializing updates to the given channel.
+func (s *Server) channelLock(channel string) *sync.Mutex {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, ok := s.updates[channel]
+	if !ok {
+		m = &sync.Mutex{}
+		s.updates[channel] = m
+	}
+	return m
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/channel"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedChannel counts updates, and holds each one until released.
+type gatedChannel struct {
+	bcgo.Channel
+	mutex   sync.Mutex
+	updates int
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *gatedChannel) Update(cache bcgo.Cache, network bcgo.Network, hash []byte, block *bcgo.Block) error {
+	c.mutex.Lock()
+	c.updates++
+	c.mutex.Unlock()
+	c.entered <- struct{}{}
+	<-c.release
+	return c.Channel.Update(cache, network, hash, block)
+}
+
+func TestInFlight(t *testing.T) {
+	source, hashes := makeChain(t, 2)
+	makeServer := func() (*bcnetgo.Server, *gatedChannel) {
+		c := &gatedChannel{
+			Channel: channel.New("Test"),
+			entered: make(chan struct{}, 2),
+			release: make(chan struct{}),
+		}
+		server := bcnetgo.NewServer(cache.NewMemory(10), nil, func(string) (bcgo.Channel, error) {
+			return c, nil
+		})
+		return server, c
+	}
+	broadcastAsync := func(server *bcnetgo.Server, source bcgo.Cache, hash []byte) chan *bcnetgo.Response {
+		responses := make(chan *bcnetgo.Response, 1)
+		go func() {
+			s, client := net.Pipe()
+			defer client.Close()
+			go server.BroadcastPortTCPHandler(s)
+			block, err := source.Block(hash)
+			if err != nil {
+				t.Error(err)
+			}
+			response, err := bcnetgo.Broadcast(client, source, block)
+			if err != nil {
+				t.Error(err)
+			}
+			responses <- response
+		}()
+		return responses
+	}
+	expectAccepted := func(t *testing.T, responses chan *bcnetgo.Response) {
+		t.Helper()
+		response := <-responses
+		if response == nil {
+			t.Fatal("Expected response")
+		}
+		if response.Outcome != bcnetgo.OUTCOME_ACCEPTED {
+			t.Fatalf("Incorrect outcome; expected '%s', got '%s'", bcnetgo.OUTCOME_ACCEPTED, response.Outcome)
+		}
+	}
+	t.Run("SameBlock", func(t *testing.T) {
+		server, c := makeServer()
+		first := broadcastAsync(server, source, hashes[0])
+		<-c.entered
+		second := broadcastAsync(server, source, hashes[0])
+		// Give second broadcast time to join the first
+		time.Sleep(100 * time.Millisecond)
+		close(c.release)
+		expectAccepted(t, first)
+		expectAccepted(t, second)
+		if c.updates != 1 {
+			t.Fatalf("Incorrect updates; expected '%d', got '%d'", 1, c.updates)
+		}
+	})
+	t.Run("OverlappingBackfill", func(t *testing.T) {
+		server, c := makeServer()
+		first := broadcastAsync(server, source, hashes[1])
+		<-c.entered
+		// Second broadcaster cannot supply the parent, so must wait for the first
+		head, err := source.Block(hashes[0])
+		testinggo.AssertNoError(t, err)
+		partial := cache.NewMemory(10)
+		testinggo.AssertNoError(t, partial.PutBlock(hashes[0], head))
+		second := broadcastAsync(server, partial, hashes[0])
+		time.Sleep(100 * time.Millisecond)
+		close(c.release)
+		expectAccepted(t, first)
+		expectAccepted(t, second)
+	})
+}
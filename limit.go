@@ -0,0 +1,168 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"net"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_CONNECTIONS        = 1000
+	DEFAULT_MAX_CONNECTIONS_PER_IP = 32
+	// MAX_RATE_BUCKETS is the number of rate limit buckets kept, idle ones are discarded first, then the least recently used.
+	MAX_RATE_BUCKETS = 10000
+	// MAX_REJECTING is the number of rate limited connections waited on at once to tell them why they are refused.
+	MAX_REJECTING = 100
+	// REJECT_TIMEOUT bounds the wait for a rate limited connection's preamble.
+	REJECT_TIMEOUT = 500 * time.Millisecond
+)
+
+var errRateLimited = errors.New("Rate limited")
+
+// Rate is a token bucket which holds up to Burst requests and refills at Limit requests per second.
+type Rate struct {
+	Limit float64
+	Burst int
+}
+
+type bucketKey struct {
+	port int
+	ip   string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// admit decides whether a connection from the given IP to the given port may be handled, and returns the reason if not.
+// The server's mutex must be held.
+func (s *Server) admit(port int, ip string) error {
+	if s.MaxConnections > 0 && len(s.conns) >= s.MaxConnections {
+		s.metrics.Rejected++
+		return errors.New("Too many connections")
+	}
+	if s.MaxConnectionsPerIP > 0 && s.connsPerIP[ip] >= s.MaxConnectionsPerIP {
+		s.metrics.Rejected++
+		return errors.New("Too many connections from address")
+	}
+	if rate, ok := s.RateLimit[port]; ok && !s.take(bucketKey{port, ip}, rate) {
+		s.metrics.RateLimited++
+		return errRateLimited
+	}
+	s.connsPerIP[ip]++
+	return nil
+}
+
+// release records that a connection from the given IP has finished.
+// The server's mutex must be held.
+func (s *Server) release(ip string) {
+	if s.connsPerIP[ip] <= 1 {
+		delete(s.connsPerIP, ip)
+	} else {
+		s.connsPerIP[ip]--
+	}
+}
+
+func (s *Server) take(key bucketKey, rate Rate) bool {
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if ok {
+		b.tokens = math.Min(float64(rate.Burst), b.tokens+now.Sub(b.last).Seconds()*rate.Limit)
+		b.last = now
+	} else {
+		if len(s.buckets) >= MAX_RATE_BUCKETS {
+			s.pruneBuckets(now)
+		}
+		if len(s.buckets) >= MAX_RATE_BUCKETS {
+			s.evictBucket()
+		}
+		b = &bucket{
+			tokens: float64(rate.Burst),
+			last:   now,
+		}
+		s.buckets[key] = b
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// pruneBuckets discards buckets which have refilled, as they are equivalent to new ones.
+func (s *Server) pruneBuckets(now time.Time) {
+	for k, b := range s.buckets {
+		rate := s.RateLimit[k.port]
+		if b.tokens+now.Sub(b.last).Seconds()*rate.Limit >= float64(rate.Burst) {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+// rejectRateLimited closes a rate limited connection, first replying STATUS_RATE_LIMITED if the peer sends a preamble within REJECT_TIMEOUT.
+// Legacy peers, and peers rejected while MAX_REJECTING others are waited on, only observe the connection closing.
+func (s *Server) rejectRateLimited(conn net.Conn) {
+	defer conn.Close()
+	s.mutex.Lock()
+	if s.rejecting >= MAX_REJECTING {
+		s.mutex.Unlock()
+		return
+	}
+	s.rejecting++
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.rejecting--
+		s.mutex.Unlock()
+	}()
+	conn.SetDeadline(time.Now().Add(REJECT_TIMEOUT))
+	version, err := ReadPreamble(bufio.NewReader(conn))
+	if err != nil || version == 0 {
+		return
+	}
+	WriteDelimitedMessage(bufio.NewWriter(conn), &Response{
+		Status:  STATUS_RATE_LIMITED,
+		Message: errRateLimited.Error(),
+	})
+}
+
+// evictBucket discards the least recently used bucket.
+func (s *Server) evictBucket() {
+	var oldest bucketKey
+	var last time.Time
+	for k, b := range s.buckets {
+		if last.IsZero() || b.last.Before(last) {
+			oldest = k
+			last = b.last
+		}
+	}
+	delete(s.buckets, oldest)
+}
+
+func remoteIP(conn net.Conn) string {
+	address := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// expectClosed fails unless the server closes the connection without it timing out.
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected error")
+	} else if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatal("Expected server to close connection")
+	}
+}
+
+// expectOpen fails unless the connection is still waiting for a request.
+func expectOpen(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected timeout")
+	} else if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("Expected timeout, got '%v'", err)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	// dialTwice opens two connections to the head port, returning once the server has accepted the first
+	dialTwice := func(t *testing.T, server *bcnetgo.Server) (net.Conn, net.Conn) {
+		t.Helper()
+		address := server.Addr(network.PORT_GET_HEAD).String()
+		first, err := net.Dial("tcp", address)
+		testinggo.AssertNoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+		second, err := net.Dial("tcp", address)
+		testinggo.AssertNoError(t, err)
+		return first, second
+	}
+	t.Run("Defaults", func(t *testing.T) {
+		server := bcnetgo.NewServer(nil, nil, nil)
+		if server.MaxConnections != bcnetgo.DEFAULT_MAX_CONNECTIONS {
+			t.Fatalf("Incorrect max connections; expected '%d', got '%d'", bcnetgo.DEFAULT_MAX_CONNECTIONS, server.MaxConnections)
+		}
+		if server.MaxConnectionsPerIP != bcnetgo.DEFAULT_MAX_CONNECTIONS_PER_IP {
+			t.Fatalf("Incorrect max connections per IP; expected '%d', got '%d'", bcnetgo.DEFAULT_MAX_CONNECTIONS_PER_IP, server.MaxConnectionsPerIP)
+		}
+	})
+	t.Run("MaxConnections", func(t *testing.T) {
+		server := makeServer(t)
+		server.MaxConnections = 1
+		testinggo.AssertNoError(t, server.Start())
+		defer server.Shutdown(context.Background())
+
+		first, second := dialTwice(t, server)
+		defer first.Close()
+		defer second.Close()
+
+		expectClosed(t, second)
+		expectOpen(t, first)
+		if got := server.Metrics().Rejected; got != 1 {
+			t.Fatalf("Incorrect rejected; expected '%d', got '%d'", 1, got)
+		}
+	})
+	t.Run("MaxConnectionsPerIP", func(t *testing.T) {
+		server := makeServer(t)
+		server.MaxConnectionsPerIP = 1
+		testinggo.AssertNoError(t, server.Start())
+		defer server.Shutdown(context.Background())
+
+		first, second := dialTwice(t, server)
+		defer first.Close()
+		defer second.Close()
+
+		expectClosed(t, second)
+		expectOpen(t, first)
+
+		// Once the first connection finishes, another may be made
+		first.Close()
+		time.Sleep(100 * time.Millisecond)
+		third, err := net.Dial("tcp", server.Addr(network.PORT_GET_HEAD).String())
+		testinggo.AssertNoError(t, err)
+		defer third.Close()
+		expectOpen(t, third)
+	})
+	t.Run("RateLimit", func(t *testing.T) {
+		server := makeServer(t)
+		server.RateLimit = map[int]bcnetgo.Rate{
+			network.PORT_GET_HEAD: {
+				Limit: 0.001,
+				Burst: 1,
+			},
+		}
+		testinggo.AssertNoError(t, server.Start())
+		defer server.Shutdown(context.Background())
+
+		first, second := dialTwice(t, server)
+		defer first.Close()
+		defer second.Close()
+
+		expectClosed(t, second)
+		expectOpen(t, first)
+		if got := server.Metrics().RateLimited; got != 1 {
+			t.Fatalf("Incorrect rate limited; expected '%d', got '%d'", 1, got)
+		}
+
+		// Versioned peers are told why they are refused
+		third, err := net.Dial("tcp", server.Addr(network.PORT_GET_HEAD).String())
+		testinggo.AssertNoError(t, err)
+		defer third.Close()
+		writer := bufio.NewWriter(third)
+		testinggo.AssertNoError(t, bcnetgo.WritePreamble(writer, bcnetgo.PROTOCOL_VERSION))
+		testinggo.AssertNoError(t, bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+		}))
+		response := &bcnetgo.Response{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(bufio.NewReader(third), response, bcnetgo.DEFAULT_MAX_BLOCK_SIZE))
+		if response.Status != bcnetgo.STATUS_RATE_LIMITED {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_RATE_LIMITED, response.Status)
+		}
+
+		// Other ports are not limited
+		other, err := net.Dial("tcp", server.Addr(network.PORT_GET_BLOCK).String())
+		testinggo.AssertNoError(t, err)
+		defer other.Close()
+		expectOpen(t, other)
+	})
+}
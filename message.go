@@ -0,0 +1,675 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/bcgo"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+)
+
+const (
+	// PROTOCOL_PREAMBLE is sent before the protocol version, legacy peers never start a connection with it.
+	PROTOCOL_PREAMBLE = 0x00
+	PROTOCOL_VERSION  = 1
+
+	MAX_HANDSHAKE_SIZE = 4 * 1024  // 4Kb
+	MAX_PEER_LIST_SIZE = 64 * 1024 // 64Kb
+
+	DEFAULT_MAX_REFERENCE_SIZE = 4 * 1024         // 4Kb
+	DEFAULT_MAX_BLOCK_SIZE     = 64 * 1024 * 1024 // 64Mb
+
+	DEFAULT_MAX_HEAD_REQUEST_SIZE = 64 * 1024 // 64Kb
+
+	DEFAULT_MAX_RANGE_BLOCKS = 1000
+	DEFAULT_MAX_HEADS        = 1000
+)
+
+// Messages are encoded in the protobuf wire format, and framed like bcgo.WriteDelimitedProtobuf.
+type Message interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+// ClientHello begins the handshake on the connect port, offering the protocol versions and features the peer supports.
+// WantPeers asks the server to end the handshake with a PeerList of up to that many peers,
+// and Private asks the server to not advertise the peer to others.
+// Server is the address the client dialed, which is covered by the client's signature so it cannot be relayed to another server.
+type ClientHello struct {
+	Alias     string
+	Versions  []uint64
+	Features  []string
+	WantPeers uint64
+	Private   bool
+	Server    string
+}
+
+func (m *ClientHello) Marshal() (b []byte, err error) {
+	b = appendString(b, 1, m.Alias)
+	for _, v := range m.Versions {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	}
+	for _, f := range m.Features {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, f)
+	}
+	b = appendVarint(b, 4, m.WantPeers)
+	if m.Private {
+		b = appendVarint(b, 5, 1)
+	}
+	b = appendString(b, 6, m.Server)
+	return
+}
+
+func (m *ClientHello) Unmarshal(data []byte) error {
+	*m = ClientHello{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeString(b, &m.Alias)
+		case num == 2:
+			return consumeVarints(num, typ, b, &m.Versions)
+		case num == 3 && typ == protowire.BytesType:
+			var f string
+			n := consumeString(b, &f)
+			m.Features = append(m.Features, f)
+			return n
+		case num == 4 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.WantPeers = v
+			return n
+		case num == 5 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Private = v != 0
+			return n
+		case num == 6 && typ == protowire.BytesType:
+			return consumeString(b, &m.Server)
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+// ServerHello answers a ClientHello with the negotiated protocol version, or zero if there is none, and the server's features.
+// The nonce is empty if the server does not authenticate peers.
+type ServerHello struct {
+	Nonce    []byte
+	Version  uint64
+	Features []string
+}
+
+func (m *ServerHello) Marshal() (b []byte, err error) {
+	b = appendBytes(b, 1, m.Nonce)
+	b = appendVarint(b, 2, m.Version)
+	for _, f := range m.Features {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, f)
+	}
+	return
+}
+
+func (m *ServerHello) Unmarshal(data []byte) error {
+	*m = ServerHello{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeBytes(b, &m.Nonce)
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Version = v
+			return n
+		case num == 3 && typ == protowire.BytesType:
+			var f string
+			n := consumeString(b, &f)
+			m.Features = append(m.Features, f)
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+// ClientProof carries the client's signature of the server's nonce, see HandshakeMessage.
+type ClientProof struct {
+	Signature []byte
+}
+
+func (m *ClientProof) Marshal() (b []byte, err error) {
+	b = appendBytes(b, 1, m.Signature)
+	return
+}
+
+func (m *ClientProof) Unmarshal(data []byte) error {
+	*m = ClientProof{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeBytes(b, &m.Signature)
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+// PeerList ends a successful handshake on the connect port when the client asked for peers.
+type PeerList struct {
+	Peers []string
+}
+
+func (m *PeerList) Marshal() (b []byte, err error) {
+	for _, p := range m.Peers {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, p)
+	}
+	return
+}
+
+func (m *PeerList) Unmarshal(data []byte) error {
+	*m = PeerList{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var p string
+			n := consumeString(b, &p)
+			m.Peers = append(m.Peers, p)
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+type Status uint64
+
+const (
+	STATUS_OK Status = iota
+	STATUS_NOT_FOUND
+	STATUS_BAD_REQUEST
+	STATUS_TOO_LARGE
+	STATUS_RATE_LIMITED
+	STATUS_INTERNAL_ERROR
+	STATUS_FORBIDDEN
+)
+
+func (s Status) String() string {
+	switch s {
+	case STATUS_OK:
+		return "OK"
+	case STATUS_NOT_FOUND:
+		return "Not Found"
+	case STATUS_BAD_REQUEST:
+		return "Bad Request"
+	case STATUS_TOO_LARGE:
+		return "Too Large"
+	case STATUS_RATE_LIMITED:
+		return "Rate Limited"
+	case STATUS_INTERNAL_ERROR:
+		return "Internal Error"
+	case STATUS_FORBIDDEN:
+		return "Forbidden"
+	}
+	return fmt.Sprintf("Status %d", uint64(s))
+}
+
+// Outcome describes what the server did with a broadcast block.
+type Outcome uint64
+
+const (
+	OUTCOME_UNKNOWN Outcome = iota
+	OUTCOME_ACCEPTED
+	OUTCOME_ALREADY_KNOWN
+	OUTCOME_SHORTER_CHAIN
+	OUTCOME_INVALID
+	OUTCOME_VALIDATION_FAILED
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OUTCOME_UNKNOWN:
+		return "Unknown"
+	case OUTCOME_ACCEPTED:
+		return "Accepted"
+	case OUTCOME_ALREADY_KNOWN:
+		return "Already Known"
+	case OUTCOME_SHORTER_CHAIN:
+		return "Shorter Chain"
+	case OUTCOME_INVALID:
+		return "Invalid"
+	case OUTCOME_VALIDATION_FAILED:
+		return "Validation Failed"
+	}
+	return fmt.Sprintf("Outcome %d", uint64(o))
+}
+
+// Request is sent on the block and head ports by peers which send a protocol preamble, legacy peers send a bare Reference.
+// On the block port, a Request with Limit or Until set asks for a range of blocks, walking Previous from the referenced block,
+// or from the channel head if the reference has no block hash, until the limit is reached or the block hash equals Until.
+// On the head port, a Request with Subscribe set asks for the head of the referenced channel and each of Channels,
+// followed by a Response whenever one of the heads changes, and a Response with Heartbeat set while they do not.
+// Otherwise, a Request with Channels or Prefix set asks for the heads of the referenced channel, each of Channels,
+// and each channel whose name starts with Prefix, in a single Response.
+// On the block port, a Request with Snapshot set asks for a range of blocks as a snapshot, see Snapshot.
+type Request struct {
+	Reference *bcgo.Reference
+	Limit     uint64
+	Until     []byte
+	Subscribe bool
+	Channels  []string
+	Prefix    string
+	Snapshot  bool
+}
+
+func (m *Request) Marshal() (b []byte, err error) {
+	if m.Reference != nil {
+		if b, err = appendProtobuf(b, 1, m.Reference); err != nil {
+			return
+		}
+	}
+	b = appendVarint(b, 2, m.Limit)
+	b = appendBytes(b, 3, m.Until)
+	if m.Subscribe {
+		b = appendVarint(b, 4, 1)
+	}
+	for _, c := range m.Channels {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, c)
+	}
+	b = appendString(b, 6, m.Prefix)
+	if m.Snapshot {
+		b = appendVarint(b, 7, 1)
+	}
+	return
+}
+
+func (m *Request) Unmarshal(data []byte) error {
+	*m = Request{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.Reference = &bcgo.Reference{}
+			return consumeProtobuf(b, m.Reference)
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Limit = v
+			return n
+		case num == 3 && typ == protowire.BytesType:
+			return consumeBytes(b, &m.Until)
+		case num == 4 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Subscribe = v != 0
+			return n
+		case num == 5 && typ == protowire.BytesType:
+			var c string
+			n := consumeString(b, &c)
+			m.Channels = append(m.Channels, c)
+			return n
+		case num == 6 && typ == protowire.BytesType:
+			return consumeString(b, &m.Prefix)
+		case num == 7 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Snapshot = v != 0
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+// IsRange returns true if the request asks for a range of blocks.
+func (m *Request) IsRange() bool {
+	return m.Limit > 0 || len(m.Until) > 0 || m.Snapshot
+}
+
+// IsMultiple returns true if the request asks for the heads of several channels.
+func (m *Request) IsMultiple() bool {
+	return len(m.Channels) > 0 || m.Prefix != ""
+}
+
+// ChannelNames returns the name of the referenced channel, if any, followed by each of Channels, without duplicates.
+func (m *Request) ChannelNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	if m.Reference != nil && m.Reference.ChannelName != "" {
+		names = append(names, m.Reference.ChannelName)
+		seen[m.Reference.ChannelName] = true
+	}
+	for _, c := range m.Channels {
+		if !seen[c] {
+			names = append(names, c)
+			seen[c] = true
+		}
+	}
+	return names
+}
+
+// Response answers a Request with a status, and the requested block or reference if successful.
+// Legacy peers receive a bare Block or Reference, or nothing if unsuccessful.
+// On the broadcast port, a Response with Missing set asks the broadcaster for a block the server does not have.
+// A range of blocks is streamed as a Response per block, with Reference holding the block's hash,
+// followed by a Response with End set, and a Reference to the next block if the server's limit truncated the range.
+// The heads of several channels are returned in Heads, each a Response holding the Status of one channel,
+// and a Reference naming the channel, with its head if successful.
+// A snapshot is streamed as Responses holding batches of Blocks, newest first, the first with a Reference to the newest block,
+// followed by a Response with End set, and a Reference to the next block if the server's limit truncated the snapshot.
+// The final Response to a broadcast holds the Outcome, the reason in Message if the block was rejected, and the channel's head.
+// On the connect port, a Response tells the peer whether the handshake succeeded, before any PeerList.
+type Response struct {
+	Status    Status
+	Message   string
+	Block     *bcgo.Block
+	Reference *bcgo.Reference
+	Missing   *bcgo.Reference
+	End       bool
+	Outcome   Outcome
+	Heartbeat bool
+	Heads     []*Response
+	Blocks    []*bcgo.Block
+}
+
+func (m *Response) Marshal() (b []byte, err error) {
+	b = appendVarint(b, 1, uint64(m.Status))
+	b = appendString(b, 2, m.Message)
+	if m.Block != nil {
+		if b, err = appendProtobuf(b, 3, m.Block); err != nil {
+			return
+		}
+	}
+	if m.Reference != nil {
+		if b, err = appendProtobuf(b, 4, m.Reference); err != nil {
+			return
+		}
+	}
+	if m.Missing != nil {
+		if b, err = appendProtobuf(b, 5, m.Missing); err != nil {
+			return
+		}
+	}
+	if m.End {
+		b = appendVarint(b, 6, 1)
+	}
+	b = appendVarint(b, 7, uint64(m.Outcome))
+	if m.Heartbeat {
+		b = appendVarint(b, 8, 1)
+	}
+	for _, h := range m.Heads {
+		data, err := h.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, data)
+	}
+	for _, block := range m.Blocks {
+		if b, err = appendProtobuf(b, 10, block); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (m *Response) Unmarshal(data []byte) error {
+	*m = Response{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Status = Status(v)
+			return n
+		case num == 2 && typ == protowire.BytesType:
+			return consumeString(b, &m.Message)
+		case num == 3 && typ == protowire.BytesType:
+			m.Block = &bcgo.Block{}
+			return consumeProtobuf(b, m.Block)
+		case num == 4 && typ == protowire.BytesType:
+			m.Reference = &bcgo.Reference{}
+			return consumeProtobuf(b, m.Reference)
+		case num == 5 && typ == protowire.BytesType:
+			m.Missing = &bcgo.Reference{}
+			return consumeProtobuf(b, m.Missing)
+		case num == 6 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.End = v != 0
+			return n
+		case num == 7 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Outcome = Outcome(v)
+			return n
+		case num == 8 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Heartbeat = v != 0
+			return n
+		case num == 9 && typ == protowire.BytesType:
+			d, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+			h := &Response{}
+			if err := h.Unmarshal(d); err != nil {
+				return -1
+			}
+			m.Heads = append(m.Heads, h)
+			return n
+		case num == 10 && typ == protowire.BytesType:
+			block := &bcgo.Block{}
+			n := consumeProtobuf(b, block)
+			m.Blocks = append(m.Blocks, block)
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+// ErrStatus is returned to clients when the server responds with an unsuccessful status.
+type ErrStatus struct {
+	Status  Status
+	Message string
+}
+
+func (e ErrStatus) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
+
+// ErrMessageTooLarge is returned when a peer announces a message larger than allowed.
+type ErrMessageTooLarge struct {
+	Size, Limit uint64
+}
+
+func (e ErrMessageTooLarge) Error() string {
+	return fmt.Sprintf("Message too large: %d exceeds limit %d", e.Size, e.Limit)
+}
+
+// ReadDelimitedMessage reads a size-prefixed message, rejecting it before allocation if it exceeds the limit.
+func ReadDelimitedMessage(reader *bufio.Reader, message Message, limit uint64) error {
+	data, err := readDelimited(reader, limit)
+	if err != nil {
+		return err
+	}
+	return message.Unmarshal(data)
+}
+
+// ReadDelimitedProtobuf is like bcgo.ReadDelimitedProtobuf, but rejects messages exceeding the limit before allocation.
+func ReadDelimitedProtobuf(reader *bufio.Reader, destination proto.Message, limit uint64) error {
+	data, err := readDelimited(reader, limit)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, destination)
+}
+
+// WriteDelimitedMessage writes a size-prefixed message and flushes the writer.
+func WriteDelimitedMessage(writer *bufio.Writer, message Message) error {
+	data, err := message.Marshal()
+	if err != nil {
+		return err
+	}
+	return writeDelimited(writer, data)
+}
+
+func readDelimited(reader *bufio.Reader, limit uint64) ([]byte, error) {
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if size > limit {
+		return nil, ErrMessageTooLarge{
+			Size:  size,
+			Limit: limit,
+		}
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeDelimited(writer *bufio.Writer, data []byte) error {
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, uint64(len(data)))
+	if _, err := writer.Write(size[:n]); err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// ReadPreamble returns the protocol version requested by the peer, or 0 if the peer uses the legacy protocol.
+func ReadPreamble(reader *bufio.Reader) (uint64, error) {
+	b, err := reader.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if b[0] != PROTOCOL_PREAMBLE {
+		return 0, nil
+	}
+	if _, err := reader.Discard(1); err != nil {
+		return 0, err
+	}
+	return binary.ReadUvarint(reader)
+}
+
+// WritePreamble requests the given protocol version, it is flushed with the first message.
+func WritePreamble(writer *bufio.Writer, version uint64) error {
+	if err := writer.WriteByte(PROTOCOL_PREAMBLE); err != nil {
+		return err
+	}
+	v := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(v, version)
+	_, err := writer.Write(v[:n])
+	return err
+}
+
+func consumeFields(data []byte, field func(protowire.Number, protowire.Type, []byte) int) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n = field(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendProtobuf(b []byte, num protowire.Number, m proto.Message) ([]byte, error) {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, data), nil
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func consumeBytes(b []byte, v *[]byte) int {
+	d, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		*v = append([]byte(nil), d...)
+	}
+	return n
+}
+
+func consumeProtobuf(b []byte, m proto.Message) int {
+	d, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		if err := proto.Unmarshal(d, m); err != nil {
+			return -1
+		}
+	}
+	return n
+}
+
+// consumeVarints appends a repeated varint field, which may be packed.
+func consumeVarints(num protowire.Number, typ protowire.Type, b []byte, v *[]uint64) int {
+	switch typ {
+	case protowire.VarintType:
+		x, n := protowire.ConsumeVarint(b)
+		if n >= 0 {
+			*v = append(*v, x)
+		}
+		return n
+	case protowire.BytesType:
+		d, n := protowire.ConsumeBytes(b)
+		for len(d) > 0 && n >= 0 {
+			x, m := protowire.ConsumeVarint(d)
+			if m < 0 {
+				return m
+			}
+			*v = append(*v, x)
+			d = d[m:]
+		}
+		return n
+	}
+	return protowire.ConsumeFieldValue(num, typ, b)
+}
+
+func consumeString(b []byte, v *string) int {
+	s, n := protowire.ConsumeString(b)
+	if n >= 0 {
+		*v = s
+	}
+	return n
+}
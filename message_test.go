@@ -0,0 +1,72 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestDelimitedMessage(t *testing.T) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		buffer := &bytes.Buffer{}
+		writer := bufio.NewWriter(buffer)
+		testinggo.AssertNoError(t, bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.ClientHello{
+			Alias: "Alice",
+		}))
+		hello := &bcnetgo.ClientHello{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(bufio.NewReader(buffer), hello, bcnetgo.MAX_HANDSHAKE_SIZE))
+		if hello.Alias != "Alice" {
+			t.Fatalf("Incorrect alias; expected '%s', got '%s'", "Alice", hello.Alias)
+		}
+	})
+	t.Run("TooLarge", func(t *testing.T) {
+		buffer := &bytes.Buffer{}
+		writer := bufio.NewWriter(buffer)
+		testinggo.AssertNoError(t, bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.ServerHello{
+			Nonce: make([]byte, 64),
+		}))
+		err := bcnetgo.ReadDelimitedMessage(bufio.NewReader(buffer), &bcnetgo.ServerHello{}, 32)
+		if _, ok := err.(bcnetgo.ErrMessageTooLarge); !ok {
+			t.Fatalf("Incorrect error; expected ErrMessageTooLarge, got '%v'", err)
+		}
+	})
+}
+
+func TestPreamble(t *testing.T) {
+	t.Run("Legacy", func(t *testing.T) {
+		version, err := bcnetgo.ReadPreamble(bufio.NewReader(bytes.NewReader([]byte("Alice"))))
+		testinggo.AssertNoError(t, err)
+		if version != 0 {
+			t.Fatalf("Incorrect version; expected '%d', got '%d'", 0, version)
+		}
+	})
+	t.Run("Version", func(t *testing.T) {
+		buffer := &bytes.Buffer{}
+		writer := bufio.NewWriter(buffer)
+		testinggo.AssertNoError(t, bcnetgo.WritePreamble(writer, bcnetgo.PROTOCOL_VERSION))
+		testinggo.AssertNoError(t, writer.Flush())
+		version, err := bcnetgo.ReadPreamble(bufio.NewReader(buffer))
+		testinggo.AssertNoError(t, err)
+		if version != bcnetgo.PROTOCOL_VERSION {
+			t.Fatalf("Incorrect version; expected '%d', got '%d'", bcnetgo.PROTOCOL_VERSION, version)
+		}
+	})
+}
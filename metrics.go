@@ -0,0 +1,44 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+// Metrics counts the connections handled by a Server.
+type Metrics struct {
+	// Accepted is the number of connections accepted.
+	Accepted uint64
+	// Timeouts is the number of connections which exceeded a deadline.
+	Timeouts uint64
+	// Rejected is the number of connections closed for exceeding a connection limit.
+	Rejected uint64
+	// RateLimited is the number of connections closed for exceeding a rate limit.
+	RateLimited uint64
+	// Banned is the number of connections closed because the remote IP or peer is banned.
+	Banned uint64
+}
+
+// Metrics returns a snapshot of the server's counters.
+func (s *Server) Metrics() Metrics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.metrics
+}
+
+func (s *Server) count(update func(*Metrics)) {
+	s.mutex.Lock()
+	update(&s.metrics)
+	s.mutex.Unlock()
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/bcgo/network"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// PORT_MULTIPLEX serves all four protocols on a single port when a Server is multiplexed.
+const PORT_MULTIPLEX = 22000
+
+// MultiplexTypes maps each port to the byte a client sends at the start of a connection to the multiplexed port to select its protocol.
+var MultiplexTypes = map[int]byte{
+	network.PORT_CONNECT:   1,
+	network.PORT_GET_BLOCK: 2,
+	network.PORT_GET_HEAD:  3,
+	network.PORT_BROADCAST: 4,
+}
+
+// ALPNProtocols maps each port to the ALPN protocol which selects it on a multiplexed port secured by TLS,
+// in which case the client does not send a leading byte.
+var ALPNProtocols = map[int]string{
+	network.PORT_CONNECT:   "bcnet-connect",
+	network.PORT_GET_BLOCK: "bcnet-block",
+	network.PORT_GET_HEAD:  "bcnet-head",
+	network.PORT_BROADCAST: "bcnet-broadcast",
+}
+
+// SelectProtocol starts a connection to a multiplexed port by sending the byte which selects the protocol of the given port.
+func SelectProtocol(conn net.Conn, port int) error {
+	t, ok := MultiplexTypes[port]
+	if !ok {
+		return fmt.Errorf("Unrecognized port: %d", port)
+	}
+	_, err := conn.Write([]byte{t})
+	return err
+}
+
+// MultiplexHandler selects the protocol of the connection by its negotiated ALPN protocol, or else by its leading byte,
+// and passes it to the handler for the corresponding port.
+func (s *Server) MultiplexHandler(conn net.Conn) {
+	address := conn.RemoteAddr().String()
+	port, err := s.selectedPort(conn)
+	if err != nil {
+		log.Println(address, err)
+		conn.Close()
+		return
+	}
+	s.mutex.Lock()
+	allowed := true
+	if rate, ok := s.RateLimit[port]; ok && !s.take(bucketKey{port, remoteIP(conn)}, rate) {
+		s.metrics.RateLimited++
+		allowed = false
+	}
+	s.mutex.Unlock()
+	if !allowed {
+		log.Println(address, errRateLimited)
+		s.rejectRateLimited(conn)
+		return
+	}
+	s.Handlers()[port](conn)
+}
+
+func (s *Server) selectedPort(conn net.Conn) (int, error) {
+	if c, ok := conn.(*timeoutConn); ok {
+		if t, ok := c.Conn.(*tls.Conn); ok {
+			if s.HandshakeTimeout > 0 {
+				t.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+			}
+			if err := t.Handshake(); err != nil {
+				return 0, err
+			}
+			if protocol := t.ConnectionState().NegotiatedProtocol; protocol != "" {
+				for port, p := range ALPNProtocols {
+					if p == protocol {
+						return port, nil
+					}
+				}
+			}
+		}
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return 0, err
+	}
+	for port, t := range MultiplexTypes {
+		if t == b[0] {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("Unrecognized protocol: %d", b[0])
+}
+
+// multiplexTLSConfig returns a copy of the configuration which also offers the ALPN protocol of each port.
+func multiplexTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	for _, port := range Ports {
+		config.NextProtos = append(config.NextProtos, ALPNProtocols[port])
+	}
+	return config
+}
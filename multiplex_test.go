@@ -0,0 +1,95 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+)
+
+func TestMultiplex(t *testing.T) {
+	makeMultiplexServer := func(t *testing.T, config *tls.Config) *bcnetgo.Server {
+		t.Helper()
+		server := makeServer(t)
+		server.Multiplex = true
+		server.Address[bcnetgo.PORT_MULTIPLEX] = "127.0.0.1:0"
+		server.TLSConfig = config
+		server.Cache.PutHead("Test", &bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   []byte("FooBar123"),
+		})
+		testinggo.AssertNoError(t, server.Start())
+		return server
+	}
+	expectHead := func(t *testing.T, conn net.Conn) {
+		t.Helper()
+		head, err := bcnetgo.RequestHead(conn, "Test")
+		testinggo.AssertNoError(t, err)
+		if string(head.BlockHash) != "FooBar123" {
+			t.Fatalf("Incorrect hash; expected '%s', got '%s'", "FooBar123", string(head.BlockHash))
+		}
+	}
+	t.Run("LeadingByte", func(t *testing.T) {
+		server := makeMultiplexServer(t, nil)
+		defer server.Shutdown(context.Background())
+		if a := server.Addr(network.PORT_GET_HEAD); a != nil {
+			t.Fatalf("Expected no address, got '%s'", a)
+		}
+
+		conn, err := net.Dial("tcp", server.Addr(bcnetgo.PORT_MULTIPLEX).String())
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		testinggo.AssertNoError(t, bcnetgo.SelectProtocol(conn, network.PORT_GET_HEAD))
+		expectHead(t, conn)
+	})
+	t.Run("UnrecognizedByte", func(t *testing.T) {
+		server := makeMultiplexServer(t, nil)
+		defer server.Shutdown(context.Background())
+
+		conn, err := net.Dial("tcp", server.Addr(bcnetgo.PORT_MULTIPLEX).String())
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte{99})
+		testinggo.AssertNoError(t, err)
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Expected connection to be closed")
+		}
+	})
+	t.Run("ALPN", func(t *testing.T) {
+		ca, caKey, _ := makeCertificate(t, "CA", nil, nil)
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+		_, _, serverCertificate := makeCertificate(t, "Server", ca, caKey)
+		server := makeMultiplexServer(t, bcnetgo.NewTLSConfig(serverCertificate, nil))
+		defer server.Shutdown(context.Background())
+
+		conn, err := tls.Dial("tcp", server.Addr(bcnetgo.PORT_MULTIPLEX).String(), &tls.Config{
+			RootCAs:    pool,
+			NextProtos: []string{bcnetgo.ALPNProtocols[network.PORT_GET_HEAD]},
+		})
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		expectHead(t, conn)
+	})
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_PEER_LIST = 50
+	// MAX_PEER_ERRORS is the number of peers and remote IPs errors are counted for, once reached expired counts are discarded, then the oldest.
+	MAX_PEER_ERRORS = 10000
+	// PEER_ERROR_TIMEOUT is how long errors are counted against a peer after its last error.
+	PEER_ERROR_TIMEOUT = time.Hour
+)
+
+type peerErrorCount struct {
+	count int
+	last  time.Time
+}
+
+// PeerErrors returns the number of errors counted against the given peer, or remote IP if the address is not a known peer.
+func (s *Server) PeerErrors(peer string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.errorCount(peer, time.Now())
+}
+
+// peerEvent records an event against the peer at the given address, counting errors and updating its reputation.
+func (s *Server) peerEvent(address string, event Event) {
+	peer := s.peerForAddress(address)
+	s.mutex.Lock()
+	if event == EVENT_SUCCESS {
+		delete(s.peerErrors, peer)
+	} else {
+		s.countError(peer, time.Now())
+	}
+	s.mutex.Unlock()
+	if s.Reputation != nil {
+		s.Reputation.Record(event, s.reputationKeys(address)...)
+	}
+	s.storePeerEvent(address, event)
+}
+
+// peerUnreachable counts a failure to dial or relay to the peer against it, so it is not shared with others until the count expires.
+func (s *Server) peerUnreachable(peer string) {
+	s.mutex.Lock()
+	s.countError(peer, time.Now())
+	s.mutex.Unlock()
+}
+
+// peerReachable clears the errors counted against a peer which was dialed and relayed to.
+func (s *Server) peerReachable(peer string) {
+	s.mutex.Lock()
+	delete(s.peerErrors, peer)
+	s.mutex.Unlock()
+}
+
+// errorCount returns the number of errors counted against the peer within PEER_ERROR_TIMEOUT of its last error.
+// The server's mutex must be held.
+func (s *Server) errorCount(peer string, now time.Time) int {
+	e, ok := s.peerErrors[peer]
+	if !ok || now.Sub(e.last) >= PEER_ERROR_TIMEOUT {
+		return 0
+	}
+	return e.count
+}
+
+// countError counts an error against the peer, starting a new count if the previous one expired.
+// The server's mutex must be held.
+func (s *Server) countError(peer string, now time.Time) {
+	e, ok := s.peerErrors[peer]
+	if !ok {
+		if len(s.peerErrors) >= MAX_PEER_ERRORS {
+			s.prunePeerErrors(now)
+		}
+		e = &peerErrorCount{}
+		s.peerErrors[peer] = e
+	} else if now.Sub(e.last) >= PEER_ERROR_TIMEOUT {
+		e.count = 0
+	}
+	e.count++
+	e.last = now
+}
+
+// prunePeerErrors discards expired error counts, or the oldest if none have expired.
+func (s *Server) prunePeerErrors(now time.Time) {
+	var oldest string
+	var last time.Time
+	for p, e := range s.peerErrors {
+		if now.Sub(e.last) >= PEER_ERROR_TIMEOUT {
+			delete(s.peerErrors, p)
+		} else if last.IsZero() || e.last.Before(last) {
+			oldest = p
+			last = e.last
+		}
+	}
+	if len(s.peerErrors) >= MAX_PEER_ERRORS {
+		delete(s.peerErrors, oldest)
+	}
+}
+
+// banned returns true if the remote IP of the address, or the alias of the peer at the address, is banned.
+func (s *Server) banned(address string) bool {
+	return s.Reputation != nil && s.Reputation.Banned(s.reputationKeys(address)...)
+}
+
+// reputationKeys returns the remote IP of the address, and the alias of the peer at the address if known.
+func (s *Server) reputationKeys(address string) []string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	keys := []string{host}
+	if alias := s.aliasForAddress(address); alias != "" && alias != host {
+		keys = append(keys, alias)
+	}
+	return keys
+}
+
+// setPrivate records whether the peer asked to not be advertised to others.
+func (s *Server) setPrivate(peer string, private bool) {
+	s.mutex.Lock()
+	if private {
+		s.private[peer] = true
+	} else {
+		delete(s.private, peer)
+	}
+	s.mutex.Unlock()
+}
+
+// peerList returns a random selection of up to limit known peers to share with the requester,
+// leaving out the requester, private peers, banned peers, and peers with errors counted against them,
+// including peers which could not be dialed or relayed to.
+func (s *Server) peerList(requester string, limit uint64) []string {
+	if s.Network == nil {
+		return nil
+	}
+	if s.MaxPeerList > 0 && limit > uint64(s.MaxPeerList) {
+		limit = uint64(s.MaxPeerList)
+	}
+	peers := s.Network.Peers()
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	var list []string
+	for _, p := range peers {
+		if uint64(len(list)) >= limit {
+			break
+		}
+		if p == requester || s.private[p] || s.errorCount(p, now) > 0 {
+			continue
+		}
+		if s.Reputation != nil && s.Reputation.Banned(p) {
+			continue
+		}
+		list = append(list, p)
+	}
+	return list
+}
+
+// peerForAddress returns the peer at the given address, or its host if it is not a known peer.
+func (s *Server) peerForAddress(address string) string {
+	if s.Network != nil {
+		if peer := s.Network.PeerForAddress(address); peer != "" {
+			return peer
+		}
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// dial opens a connection to the given port of a peer, secured by TLS if the server's ports are.
+// In Multiplex mode the peer's PORT_MULTIPLEX is dialed instead, and the protocol of the port is selected by ALPN or its leading byte.
+func (s *Server) dial(peer string, port int) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial(peer, port)
+	}
+	var timeout time.Duration
+	if s.Network != nil {
+		timeout = s.Network.DialTimeout
+	}
+	target := port
+	if s.Multiplex {
+		target = PORT_MULTIPLEX
+	}
+	address := net.JoinHostPort(peer, strconv.Itoa(target))
+	var conn net.Conn
+	var err error
+	if s.TLSConfig == nil {
+		conn, err = net.DialTimeout("tcp", address, timeout)
+	} else {
+		config := s.DialTLSConfig
+		if config == nil {
+			config = ClientTLSConfig(s.TLSConfig)
+		}
+		if s.Multiplex {
+			config = config.Clone()
+			config.NextProtos = []string{ALPNProtocols[port]}
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{
+			Timeout: timeout,
+		}, "tcp", address, config)
+	}
+	if err != nil || !s.Multiplex {
+		return conn, err
+	}
+	if c, ok := conn.(*tls.Conn); ok && c.ConnectionState().NegotiatedProtocol == ALPNProtocols[port] {
+		return conn, nil
+	}
+	if err := SelectProtocol(conn, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
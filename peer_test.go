@@ -0,0 +1,129 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"net"
+	"sort"
+	"testing"
+)
+
+func TestPeerExchange(t *testing.T) {
+	// connect runs the handshake with the given hello against the server, and returns the peers it shares
+	connect := func(t *testing.T, server *bcnetgo.Server, hello *bcnetgo.ClientHello) []string {
+		t.Helper()
+		s, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			server.ConnectPortTCPHandler(s)
+			close(done)
+		}()
+		_, peers, err := bcnetgo.ConnectWith(client, hello, nil)
+		testinggo.AssertNoError(t, err)
+		client.Close()
+		<-done
+		sort.Strings(peers)
+		return peers
+	}
+	expectPeers := func(t *testing.T, expected, got []string) {
+		t.Helper()
+		if len(expected) != len(got) {
+			t.Fatalf("Incorrect peers; expected '%v', got '%v'", expected, got)
+		}
+		for i, p := range expected {
+			if got[i] != p {
+				t.Fatalf("Incorrect peers; expected '%v', got '%v'", expected, got)
+			}
+		}
+	}
+	t.Run("Shared", func(t *testing.T) {
+		server := bcnetgo.NewServer(nil, makeNetwork(t), nil)
+		server.Network.AddPeer("Bob")
+		server.Network.AddPeer("Charlie")
+		peers := connect(t, server, &bcnetgo.ClientHello{
+			Alias:     "Alice",
+			WantPeers: 10,
+		})
+		expectPeers(t, []string{"Bob", "Charlie"}, peers)
+	})
+	t.Run("NotWanted", func(t *testing.T) {
+		server := bcnetgo.NewServer(nil, makeNetwork(t), nil)
+		server.Network.AddPeer("Bob")
+		peers := connect(t, server, &bcnetgo.ClientHello{
+			Alias: "Alice",
+		})
+		expectPeers(t, nil, peers)
+	})
+	t.Run("Limit", func(t *testing.T) {
+		server := bcnetgo.NewServer(nil, makeNetwork(t), nil)
+		server.MaxPeerList = 2
+		for _, p := range []string{"Bob", "Charlie", "Dave", "Eve"} {
+			server.Network.AddPeer(p)
+		}
+		if peers := connect(t, server, &bcnetgo.ClientHello{
+			Alias:     "Alice",
+			WantPeers: 1,
+		}); len(peers) != 1 {
+			t.Fatalf("Incorrect peers; expected '%d', got '%d'", 1, len(peers))
+		}
+		if peers := connect(t, server, &bcnetgo.ClientHello{
+			Alias:     "Alice",
+			WantPeers: 10,
+		}); len(peers) != 2 {
+			t.Fatalf("Incorrect peers; expected '%d', got '%d'", 2, len(peers))
+		}
+	})
+	t.Run("Private", func(t *testing.T) {
+		server := bcnetgo.NewServer(nil, makeNetwork(t), nil)
+		server.Network.AddPeer("Bob")
+		connect(t, server, &bcnetgo.ClientHello{
+			Alias:   "Charlie",
+			Private: true,
+		})
+		peers := connect(t, server, &bcnetgo.ClientHello{
+			Alias:     "Alice",
+			WantPeers: 10,
+		})
+		expectPeers(t, []string{"Bob"}, peers)
+	})
+	t.Run("PeerErrors", func(t *testing.T) {
+		server := bcnetgo.NewServer(nil, makeNetwork(t), nil)
+		server.MaxRequestSize = map[int]uint64{
+			network.PORT_GET_BLOCK: 8,
+		}
+		// Pipe connections come from address "pipe"
+		server.Network.AddPeer("pipe")
+		server.Network.AddPeer("Bob")
+		s, client := net.Pipe()
+		go server.BlockPortTCPHandler(s)
+		_, err := bcnetgo.RequestBlock(client, &bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   make([]byte, 64),
+		})
+		expectStatus(t, bcnetgo.STATUS_TOO_LARGE, err)
+		client.Close()
+		peers := connect(t, server, &bcnetgo.ClientHello{
+			Alias:     "Alice",
+			WantPeers: 10,
+		})
+		expectPeers(t, []string{"Bob"}, peers)
+	})
+}
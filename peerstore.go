@@ -0,0 +1,290 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_PEER_FAILURES = 16
+	// MAX_PEER_RECORDS is the number of peers remembered, once reached untrusted peers, and then others, are forgotten least recently seen first.
+	MAX_PEER_RECORDS = 1000
+	// DEFAULT_PEER_FLUSH_INTERVAL is how often a server flushes its peer store.
+	DEFAULT_PEER_FLUSH_INTERVAL = time.Minute
+)
+
+// PeerFailure is an error observed from a peer.
+type PeerFailure struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+}
+
+// PeerRecord is what a server remembers about a peer across restarts.
+type PeerRecord struct {
+	Alias       string    `json:"alias"`
+	Address     string    `json:"address,omitempty"`
+	Verified    bool      `json:"verified,omitempty"`
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	// Failures holds the most recent failures, oldest first, up to MAX_PEER_FAILURES.
+	Failures []PeerFailure `json:"failures,omitempty"`
+}
+
+// Trusted returns true if the peer proved its alias, or a broadcast from it was accepted.
+// Only trusted peers are saved by FilePeerStore and added to the network at start.
+func (r *PeerRecord) Trusted() bool {
+	return r.Verified || !r.LastSuccess.IsZero()
+}
+
+// PeerStore persists the peers observed by a server.
+type PeerStore interface {
+	// Records returns every stored peer.
+	Records() ([]*PeerRecord, error)
+	// Update applies the update to the record for the alias, creating it if necessary.
+	Update(alias string, update func(*PeerRecord)) error
+	// Flush persists any updates which have not yet been.
+	Flush() error
+}
+
+// MemoryPeerStore is a PeerStore held in memory.
+type MemoryPeerStore struct {
+	mutex   sync.Mutex
+	records map[string]*PeerRecord
+}
+
+func NewMemoryPeerStore() *MemoryPeerStore {
+	return &MemoryPeerStore{
+		records: make(map[string]*PeerRecord),
+	}
+}
+
+func (m *MemoryPeerStore) Records() ([]*PeerRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.copyRecords(), nil
+}
+
+func (m *MemoryPeerStore) Update(alias string, update func(*PeerRecord)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.update(alias, update)
+	return nil
+}
+
+func (m *MemoryPeerStore) Flush() error {
+	return nil
+}
+
+func (m *MemoryPeerStore) update(alias string, update func(*PeerRecord)) {
+	if m.records == nil {
+		m.records = make(map[string]*PeerRecord)
+	}
+	r, ok := m.records[alias]
+	if !ok {
+		if len(m.records) >= MAX_PEER_RECORDS {
+			m.evict()
+		}
+		r = &PeerRecord{
+			Alias: alias,
+		}
+		m.records[alias] = r
+	}
+	update(r)
+}
+
+// evict forgets the least recently seen untrusted peer, or the least recently seen peer if all are trusted.
+func (m *MemoryPeerStore) evict() {
+	var oldest *PeerRecord
+	for _, r := range m.records {
+		if oldest == nil || (oldest.Trusted() && !r.Trusted()) || (oldest.Trusted() == r.Trusted() && r.LastSeen.Before(oldest.LastSeen)) {
+			oldest = r
+		}
+	}
+	if oldest != nil {
+		delete(m.records, oldest.Alias)
+	}
+}
+
+func (m *MemoryPeerStore) copyRecords() []*PeerRecord {
+	var records []*PeerRecord
+	for _, r := range m.records {
+		c := *r
+		c.Failures = append([]PeerFailure(nil), r.Failures...)
+		records = append(records, &c)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Alias < records[j].Alias
+	})
+	return records
+}
+
+// FilePeerStore is a PeerStore whose trusted peers are saved to a JSON file when flushed.
+type FilePeerStore struct {
+	MemoryPeerStore
+	File  string
+	dirty bool
+}
+
+// NewFilePeerStore returns a FilePeerStore for the file, loading any peers already saved in it.
+func NewFilePeerStore(file string) (*FilePeerStore, error) {
+	f := &FilePeerStore{
+		MemoryPeerStore: MemoryPeerStore{
+			records: make(map[string]*PeerRecord),
+		},
+		File: file,
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		// Nothing saved yet
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []*PeerRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if !r.Trusted() {
+			// Peers which have only failed are not worth remembering
+			continue
+		}
+		f.records[r.Alias] = r
+	}
+	return f, nil
+}
+
+func (f *FilePeerStore) Update(alias string, update func(*PeerRecord)) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.update(alias, update)
+	f.dirty = true
+	return nil
+}
+
+// Flush saves the trusted peers to File if they have been updated since the last flush.
+func (f *FilePeerStore) Flush() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.dirty {
+		return nil
+	}
+	var records []*PeerRecord
+	for _, r := range f.copyRecords() {
+		if r.Trusted() {
+			records = append(records, r)
+		}
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(f.File, data); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// startPeerFlush starts flushing the peer store every PeerFlushInterval, it is called by Start with the mutex held.
+func (s *Server) startPeerFlush() {
+	s.serving.Add(1)
+	go func() {
+		defer s.serving.Done()
+		ticker := time.NewTicker(s.PeerFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.PeerStore.Flush(); err != nil {
+					log.Println(err)
+				}
+			case <-s.stopped:
+				return
+			}
+		}
+	}()
+}
+
+// loadPeers adds the trusted stored peers to the network, except those which are banned.
+func (s *Server) loadPeers() error {
+	if s.PeerStore == nil || s.Network == nil {
+		return nil
+	}
+	records, err := s.PeerStore.Records()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if !r.Trusted() || s.Reputation != nil && s.Reputation.Banned(r.Alias) {
+			continue
+		}
+		s.Network.AddPeer(r.Alias)
+	}
+	return nil
+}
+
+// storePeer records that the peer connected from the given address, and whether it proved its alias.
+func (s *Server) storePeer(address, peer string, verified bool) {
+	if s.PeerStore == nil {
+		return
+	}
+	if err := s.PeerStore.Update(peer, func(r *PeerRecord) {
+		r.Address = address
+		r.LastSeen = time.Now()
+		if verified {
+			r.Verified = true
+		}
+	}); err != nil {
+		log.Println(address, err)
+	}
+}
+
+// storePeerEvent records the event against the stored peer at the given address, if it is known.
+func (s *Server) storePeerEvent(address string, event Event) {
+	if s.PeerStore == nil {
+		return
+	}
+	peer := s.aliasForAddress(address)
+	if peer == "" {
+		return
+	}
+	now := time.Now()
+	if err := s.PeerStore.Update(peer, func(r *PeerRecord) {
+		r.LastSeen = now
+		if event == EVENT_SUCCESS {
+			r.LastSuccess = now
+			return
+		}
+		r.Failures = append(r.Failures, PeerFailure{
+			Time:  now,
+			Event: event.String(),
+		})
+		if len(r.Failures) > MAX_PEER_FAILURES {
+			r.Failures = r.Failures[len(r.Failures)-MAX_PEER_FAILURES:]
+		}
+	}); err != nil {
+		log.Println(address, err)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilePeerStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peers")
+	testinggo.AssertNoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "peers.json")
+
+	store, err := bcnetgo.NewFilePeerStore(file)
+	testinggo.AssertNoError(t, err)
+	now := time.Now()
+	testinggo.AssertNoError(t, store.Update("Alice", func(r *bcnetgo.PeerRecord) {
+		r.Address = "10.0.0.1:1234"
+		r.LastSeen = now
+		r.Verified = true
+	}))
+	// Peers which have only failed are not saved
+	testinggo.AssertNoError(t, store.Update("Bob", func(r *bcnetgo.PeerRecord) {
+		r.Failures = append(r.Failures, bcnetgo.PeerFailure{
+			Time:  now,
+			Event: bcnetgo.EVENT_MALFORMED.String(),
+		})
+	}))
+
+	// Updates are only written when flushed
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("Expected file to not be written before flush")
+	}
+	testinggo.AssertNoError(t, store.Flush())
+
+	store, err = bcnetgo.NewFilePeerStore(file)
+	testinggo.AssertNoError(t, err)
+	records, err := store.Records()
+	testinggo.AssertNoError(t, err)
+	if len(records) != 1 {
+		t.Fatalf("Incorrect records; expected '%d', got '%d'", 1, len(records))
+	}
+	if records[0].Alias != "Alice" || records[0].Address != "10.0.0.1:1234" || !records[0].LastSeen.Equal(now) {
+		t.Fatalf("Incorrect record; got '%+v'", records[0])
+	}
+}
+
+func TestMemoryPeerStore(t *testing.T) {
+	t.Run("Evict", func(t *testing.T) {
+		store := bcnetgo.NewMemoryPeerStore()
+		now := time.Now()
+		store.Update("Alice", func(r *bcnetgo.PeerRecord) {
+			r.LastSeen = now.Add(-time.Hour)
+			r.Verified = true
+		})
+		for i := 0; i < bcnetgo.MAX_PEER_RECORDS; i++ {
+			store.Update(fmt.Sprintf("Peer%d", i), func(r *bcnetgo.PeerRecord) {
+				r.LastSeen = now.Add(time.Duration(i) * time.Second)
+			})
+		}
+		records, err := store.Records()
+		testinggo.AssertNoError(t, err)
+		if len(records) != bcnetgo.MAX_PEER_RECORDS {
+			t.Fatalf("Incorrect records; expected '%d', got '%d'", bcnetgo.MAX_PEER_RECORDS, len(records))
+		}
+		// The least recently seen untrusted peer is forgotten before the trusted one
+		for _, r := range records {
+			if r.Alias == "Peer0" {
+				t.Fatal("Expected least recently seen untrusted peer to be evicted")
+			}
+		}
+		if records[0].Alias != "Alice" {
+			t.Fatalf("Incorrect record; expected '%s', got '%s'", "Alice", records[0].Alias)
+		}
+	})
+}
+
+func TestServerPeerStore(t *testing.T) {
+	t.Run("LoadedAtStart", func(t *testing.T) {
+		server := makeServer(t)
+		server.PeerStore = bcnetgo.NewMemoryPeerStore()
+		server.PeerStore.Update("Alice", func(r *bcnetgo.PeerRecord) {
+			r.LastSuccess = time.Now()
+		})
+		server.PeerStore.Update("Bob", func(r *bcnetgo.PeerRecord) {})
+		testinggo.AssertNoError(t, server.Start())
+		defer server.Shutdown(context.Background())
+
+		peers := server.Network.Peers()
+		if len(peers) != 1 || peers[0] != "Alice" {
+			t.Fatalf("Incorrect peers; expected '%v', got '%v'", []string{"Alice"}, peers)
+		}
+	})
+	t.Run("FlushedAtShutdown", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "peers")
+		testinggo.AssertNoError(t, err)
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "peers.json")
+		store, err := bcnetgo.NewFilePeerStore(file)
+		testinggo.AssertNoError(t, err)
+
+		server := makeServer(t)
+		server.PeerStore = store
+		testinggo.AssertNoError(t, server.Start())
+		store.Update("Alice", func(r *bcnetgo.PeerRecord) {
+			r.Verified = true
+		})
+		testinggo.AssertNoError(t, server.Shutdown(context.Background()))
+
+		store, err = bcnetgo.NewFilePeerStore(file)
+		testinggo.AssertNoError(t, err)
+		records, err := store.Records()
+		testinggo.AssertNoError(t, err)
+		if len(records) != 1 || records[0].Alias != "Alice" {
+			t.Fatalf("Incorrect records; got '%+v'", records)
+		}
+	})
+	t.Run("Connect", func(t *testing.T) {
+		server := bcnetgo.NewServer(nil, makeNetwork(t), nil)
+		server.PeerStore = bcnetgo.NewMemoryPeerStore()
+		s, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			server.ConnectPortTCPHandler(s)
+			close(done)
+		}()
+		_, err := bcnetgo.Connect(client, "Alice", nil)
+		testinggo.AssertNoError(t, err)
+		client.Close()
+		<-done
+
+		records, err := server.PeerStore.Records()
+		testinggo.AssertNoError(t, err)
+		if len(records) != 1 || records[0].Alias != "Alice" || records[0].Address != "pipe" || records[0].LastSeen.IsZero() {
+			t.Fatalf("Incorrect records; got '%+v'", records)
+		}
+	})
+}
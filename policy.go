@@ -0,0 +1,187 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"time"
+)
+
+const (
+	DEFAULT_ALIAS_TIMEOUT = 10 * time.Minute
+	// MAX_ALIASES is the number of verified aliases remembered, once reached expired aliases are discarded.
+	MAX_ALIASES = 10000
+)
+
+type verifiedAlias struct {
+	alias   string
+	expires time.Time
+}
+
+// ChannelPolicy decides which peers may read from and write to each channel.
+// Peer is the alias verified on the connect port within AliasTimeout by the same TLS client certificate, or else the same remote IP,
+// or the peer known to the network, or empty.
+type ChannelPolicy interface {
+	CanRead(address, peer, channel string) bool
+	CanWrite(address, peer, channel string) bool
+}
+
+// AccessList restricts the listed channels to the listed peers, other channels may be read and written by anyone.
+type AccessList struct {
+	Readers map[string][]string
+	Writers map[string][]string
+}
+
+func (a *AccessList) CanRead(address, peer, channel string) bool {
+	return allowedPeer(a.Readers, peer, channel)
+}
+
+func (a *AccessList) CanWrite(address, peer, channel string) bool {
+	return allowedPeer(a.Writers, peer, channel)
+}
+
+func allowedPeer(peers map[string][]string, peer, channel string) bool {
+	allowed, ok := peers[channel]
+	if !ok {
+		return true
+	}
+	if peer == "" {
+		return false
+	}
+	for _, p := range allowed {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) canRead(conn net.Conn, channel string) bool {
+	if s.Policy == nil {
+		return true
+	}
+	address := conn.RemoteAddr().String()
+	return s.Policy.CanRead(address, s.aliasForConn(conn), channel)
+}
+
+func (s *Server) canWrite(conn net.Conn, channel string) bool {
+	if s.Policy == nil {
+		return true
+	}
+	address := conn.RemoteAddr().String()
+	return s.Policy.CanWrite(address, s.aliasForConn(conn), channel)
+}
+
+// aliasForConn returns the unexpired alias verified by the identity of the connection, or the network's peer for its address.
+// WebSocket connections have no alias, as a browser may make them on behalf of any site.
+func (s *Server) aliasForConn(conn net.Conn) string {
+	if isWebSocket(conn) {
+		return ""
+	}
+	if alias := s.verifiedAlias(identity(conn)); alias != "" {
+		return alias
+	}
+	if s.Network != nil {
+		return s.Network.PeerForAddress(conn.RemoteAddr().String())
+	}
+	return ""
+}
+
+// aliasForAddress returns the unexpired alias verified from the address's host, or the network's peer for the address.
+func (s *Server) aliasForAddress(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if alias := s.verifiedAlias(host); alias != "" {
+		return alias
+	}
+	if s.Network != nil {
+		return s.Network.PeerForAddress(address)
+	}
+	return ""
+}
+
+func (s *Server) verifiedAlias(identity string) string {
+	if identity == "" {
+		return ""
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	a, ok := s.aliases[identity]
+	if !ok {
+		return ""
+	}
+	if time.Now().After(a.expires) {
+		delete(s.aliases, identity)
+		return ""
+	}
+	return a.alias
+}
+
+// setAlias records the alias verified by the connection until AliasTimeout elapses.
+func (s *Server) setAlias(conn net.Conn, alias string) {
+	key := identity(conn)
+	if key == "" {
+		return
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.aliases) >= MAX_ALIASES {
+		for k, a := range s.aliases {
+			if now.After(a.expires) {
+				delete(s.aliases, k)
+			}
+		}
+		if len(s.aliases) >= MAX_ALIASES {
+			return
+		}
+	}
+	s.aliases[key] = verifiedAlias{
+		alias:   alias,
+		expires: now.Add(s.AliasTimeout),
+	}
+}
+
+// identity returns the fingerprint of the certificate a TLS connection's peer was verified by,
+// or else the remote IP of the connection.
+func identity(conn net.Conn) string {
+	if isWebSocket(conn) {
+		return ""
+	}
+	if c, ok := conn.(*timeoutConn); ok {
+		conn = c.Conn
+	}
+	if c, ok := conn.(*tls.Conn); ok {
+		if state := c.ConnectionState(); len(state.VerifiedChains) > 0 {
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			return "tls:" + base64.RawURLEncoding.EncodeToString(sum[:])
+		}
+	}
+	return remoteIP(conn)
+}
+
+func forbiddenResponse(channel string) *Response {
+	return &Response{
+		Status:  STATUS_FORBIDDEN,
+		Message: "Access to " + channel + " forbidden",
+	}
+}
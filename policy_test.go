@@ -0,0 +1,153 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/channel"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	acl := &bcnetgo.AccessList{
+		Readers: map[string][]string{
+			"Private": {"Alice", "Bob"},
+		},
+		Writers: map[string][]string{
+			"Private": {"Alice"},
+		},
+	}
+	t.Run("Unrestricted", func(t *testing.T) {
+		if !acl.CanRead("", "", "Public") || !acl.CanWrite("", "", "Public") {
+			t.Fatal("Expected unlisted channel to be unrestricted")
+		}
+	})
+	t.Run("Reader", func(t *testing.T) {
+		if !acl.CanRead("", "Bob", "Private") {
+			t.Fatal("Expected reader to be allowed to read")
+		}
+		if acl.CanWrite("", "Bob", "Private") {
+			t.Fatal("Expected reader to not be allowed to write")
+		}
+	})
+	t.Run("Unknown", func(t *testing.T) {
+		if acl.CanRead("", "", "Private") || acl.CanRead("", "Charlie", "Private") {
+			t.Fatal("Expected unknown peer to not be allowed to read")
+		}
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	c, hash, block := makeCache(t)
+	acl := &bcnetgo.AccessList{
+		Readers: map[string][]string{
+			"Test": {"Alice"},
+		},
+		Writers: map[string][]string{
+			"Test": {"Alice"},
+		},
+	}
+	makePolicyServer := func() *bcnetgo.Server {
+		server := bcnetgo.NewServer(c, makeNetwork(t), func(string) (bcgo.Channel, error) {
+			return channel.New("Test"), nil
+		})
+		server.Policy = acl
+		return server
+	}
+	requestHead := func(server *bcnetgo.Server) (*bcgo.Reference, error) {
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.HeadPortTCPHandler(s)
+		return bcnetgo.RequestHead(client, "Test")
+	}
+	t.Run("HeadForbidden", func(t *testing.T) {
+		_, err := requestHead(makePolicyServer())
+		expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+	})
+	t.Run("BlockForbidden", func(t *testing.T) {
+		server := makePolicyServer()
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BlockPortTCPHandler(s)
+		// Requesting through another channel name must not reveal the block
+		_, err := bcnetgo.RequestBlock(client, &bcgo.Reference{
+			ChannelName: "Other",
+			BlockHash:   hash,
+		})
+		expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+	})
+	t.Run("BroadcastForbidden", func(t *testing.T) {
+		server := makePolicyServer()
+		server.Cache = cache.NewMemory(10)
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BroadcastPortTCPHandler(s)
+		_, err := bcnetgo.Broadcast(client, c, block)
+		expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+	})
+	t.Run("NetworkPeer", func(t *testing.T) {
+		server := makePolicyServer()
+		// Pipe connections come from address "pipe"
+		server.Policy = &bcnetgo.AccessList{
+			Readers: map[string][]string{
+				"Test": {"pipe"},
+			},
+		}
+		server.Network.AddPeer("pipe")
+		_, err := requestHead(server)
+		testinggo.AssertNoError(t, err)
+	})
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	testinggo.AssertNoError(t, err)
+	// connectAlice verifies the alias Alice with the server's connect handler
+	connectAlice := func(server *bcnetgo.Server) {
+		server.Verify = bcnetgo.RSAAliasVerifier(func(alias string) (*rsa.PublicKey, error) {
+			return &key.PublicKey, nil
+		})
+		s, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			server.ConnectPortTCPHandler(s)
+			close(done)
+		}()
+		_, err := bcnetgo.Connect(client, "Alice", bcnetgo.RSASigner(key))
+		testinggo.AssertNoError(t, err)
+		client.Close()
+		<-done
+	}
+	t.Run("VerifiedAlias", func(t *testing.T) {
+		server := makePolicyServer()
+		connectAlice(server)
+		_, err := requestHead(server)
+		testinggo.AssertNoError(t, err)
+	})
+	t.Run("VerifiedAliasExpired", func(t *testing.T) {
+		server := makePolicyServer()
+		server.AliasTimeout = time.Millisecond
+		connectAlice(server)
+		time.Sleep(10 * time.Millisecond)
+		_, err := requestHead(server)
+		expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+	})
+}
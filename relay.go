@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/network"
+	"encoding/base64"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RELAY_FANOUT = 8
+	DEFAULT_RELAY_QUEUE  = 100
+	MAX_RELAYED_HASHES   = 10000
+)
+
+type relayItem struct {
+	sender string
+	hash   []byte
+	block  *bcgo.Block
+}
+
+// hashSet remembers a bounded number of hashes, forgetting the oldest first.
+type hashSet struct {
+	limit  int
+	hashes map[string]bool
+	order  []string
+}
+
+func newHashSet(limit int) *hashSet {
+	return &hashSet{
+		limit:  limit,
+		hashes: make(map[string]bool),
+	}
+}
+
+// add returns false if the hash is already in the set.
+func (h *hashSet) add(hash []byte) bool {
+	key := base64.RawURLEncoding.EncodeToString(hash)
+	if h.hashes[key] {
+		return false
+	}
+	if len(h.order) >= h.limit {
+		delete(h.hashes, h.order[0])
+		h.order = h.order[1:]
+	}
+	h.hashes[key] = true
+	h.order = append(h.order, key)
+	return true
+}
+
+// startRelay starts forwarding accepted broadcasts to peers, it is called by Start with the mutex held.
+func (s *Server) startRelay() {
+	s.relays = make(chan relayItem, s.RelayQueue)
+	s.serving.Add(1)
+	go func(relays <-chan relayItem) {
+		defer s.serving.Done()
+		for {
+			select {
+			case item := <-relays:
+				s.relay(item)
+			case <-s.stopped:
+				return
+			}
+		}
+	}(s.relays)
+}
+
+// enqueueRelay queues an accepted block to be forwarded to peers, unless it has already been relayed.
+// It blocks while the queue is full, holding the broadcaster's connection open as backpressure.
+func (s *Server) enqueueRelay(address string, hash []byte, block *bcgo.Block) {
+	s.mutex.Lock()
+	relays := s.relays
+	fresh := relays != nil && s.relayed.add(hash)
+	s.mutex.Unlock()
+	if !fresh {
+		return
+	}
+	select {
+	case relays <- relayItem{
+		sender: s.peerForAddress(address),
+		hash:   hash,
+		block:  block,
+	}:
+	case <-s.stopped:
+	}
+}
+
+// relay forwards the block to a random selection of peers, excluding the one which sent it.
+func (s *Server) relay(item relayItem) {
+	if s.Network == nil {
+		return
+	}
+	peers := s.Network.Peers()
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	var wg sync.WaitGroup
+	count := 0
+	for _, p := range peers {
+		if p == item.sender {
+			continue
+		}
+		if s.Reputation != nil && s.Reputation.Banned(p) {
+			continue
+		}
+		if s.Policy != nil && !s.Policy.CanRead("", p, item.block.ChannelName) {
+			// Peer may not see this channel
+			continue
+		}
+		if s.RelayFanout > 0 && count >= s.RelayFanout {
+			break
+		}
+		count++
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if err := s.relayTo(peer, item); err != nil {
+				log.Println(peer, "Relay", err)
+				s.peerUnreachable(peer)
+			} else {
+				s.peerReachable(peer)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (s *Server) relayTo(peer string, item relayItem) error {
+	conn, err := s.dial(peer, network.PORT_BROADCAST)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.SessionTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.SessionTimeout))
+	}
+	if c, ok := s.Capabilities(peer); ok && c.Version >= PROTOCOL_VERSION {
+		response, err := Broadcast(conn, s.Cache, item.block)
+		if err != nil {
+			return err
+		}
+		log.Println(peer, "Relay", item.block.ChannelName, base64.RawURLEncoding.EncodeToString(item.hash), response.Outcome)
+		return nil
+	}
+	return broadcastLegacy(conn, s.Cache, item.hash, item.block)
+}
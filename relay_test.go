@@ -0,0 +1,171 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/channel"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	source, hashes := makeChain(t, 2)
+
+	// makeRelay returns a started server which relays to the given peers,
+	// and a channel receiving the name of each peer the block is relayed to.
+	makeRelay := func(t *testing.T, fanout int, peers ...string) (*bcnetgo.Server, chan string) {
+		t.Helper()
+		server := makeServer(t)
+		c := channel.New("Test")
+		server.Open = func(name string) (bcgo.Channel, error) {
+			return c, nil
+		}
+		server.Relay = true
+		server.RelayFanout = fanout
+		for _, p := range peers {
+			server.Network.AddPeer(p)
+		}
+		relayed := make(chan string, len(peers))
+		var mutex sync.Mutex
+		server.Dial = func(peer string, port int) (net.Conn, error) {
+			if port != network.PORT_BROADCAST {
+				// Dial is called by the relay goroutine, so the test cannot be stopped here
+				t.Errorf("Incorrect port; expected '%d', got '%d'", network.PORT_BROADCAST, port)
+				return nil, fmt.Errorf("Unexpected port: %d", port)
+			}
+			// Each peer accepts the relayed block as a legacy peer
+			peerChannel := channel.New("Test")
+			peerServer := bcnetgo.NewServer(cache.NewMemory(10), nil, func(string) (bcgo.Channel, error) {
+				return peerChannel, nil
+			})
+			s, client := net.Pipe()
+			go func() {
+				peerServer.BroadcastPortTCPHandler(s)
+				mutex.Lock()
+				defer mutex.Unlock()
+				if bytes.Equal(peerChannel.Head(), hashes[0]) {
+					relayed <- peer
+				}
+			}()
+			return client, nil
+		}
+		testinggo.AssertNoError(t, server.Start())
+		return server, relayed
+	}
+	shutdown := func(t *testing.T, server *bcnetgo.Server) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		testinggo.AssertNoError(t, server.Shutdown(ctx))
+	}
+	expectRelayed := func(t *testing.T, relayed chan string) string {
+		t.Helper()
+		select {
+		case peer := <-relayed:
+			return peer
+		case <-time.After(time.Second):
+			t.Fatal("Expected block to be relayed")
+		}
+		return ""
+	}
+	expectNotRelayed := func(t *testing.T, relayed chan string) {
+		t.Helper()
+		select {
+		case peer := <-relayed:
+			t.Fatalf("Expected block to not be relayed, got '%s'", peer)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.Run("ExcludesSender", func(t *testing.T) {
+		// Pipe connections come from address "pipe"
+		server, relayed := makeRelay(t, 0, "pipe", "Bob")
+		defer shutdown(t, server)
+		broadcast(t, server, source, hashes[0])
+		if peer := expectRelayed(t, relayed); peer != "Bob" {
+			t.Fatalf("Incorrect peer; expected '%s', got '%s'", "Bob", peer)
+		}
+		expectNotRelayed(t, relayed)
+	})
+	t.Run("Fanout", func(t *testing.T) {
+		server, relayed := makeRelay(t, 1, "Bob", "Charlie")
+		defer shutdown(t, server)
+		broadcast(t, server, source, hashes[0])
+		expectRelayed(t, relayed)
+		expectNotRelayed(t, relayed)
+	})
+	t.Run("Deduplicated", func(t *testing.T) {
+		server, relayed := makeRelay(t, 0, "Bob")
+		defer shutdown(t, server)
+		broadcast(t, server, source, hashes[0])
+		expectRelayed(t, relayed)
+		// Channel head is reset so the same block is accepted again
+		server.Open = func(name string) (bcgo.Channel, error) {
+			return channel.New("Test"), nil
+		}
+		response := broadcast(t, server, source, hashes[0])
+		if response.Outcome != bcnetgo.OUTCOME_ACCEPTED {
+			t.Fatalf("Incorrect outcome; expected '%s', got '%s'", bcnetgo.OUTCOME_ACCEPTED, response.Outcome)
+		}
+		expectNotRelayed(t, relayed)
+	})
+	t.Run("Unreachable", func(t *testing.T) {
+		server := makeServer(t)
+		c := channel.New("Test")
+		server.Open = func(name string) (bcgo.Channel, error) {
+			return c, nil
+		}
+		server.Relay = true
+		server.Network.AddPeer("Bob")
+		server.Dial = func(peer string, port int) (net.Conn, error) {
+			return nil, errors.New("Connection refused")
+		}
+		testinggo.AssertNoError(t, server.Start())
+		defer shutdown(t, server)
+		broadcast(t, server, source, hashes[0])
+		for i := 0; server.PeerErrors("Bob") == 0; i++ {
+			if i >= 100 {
+				t.Fatal("Expected failed relay to be counted")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Unreachable peer is not shared
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.ConnectPortTCPHandler(s)
+		_, peers, err := bcnetgo.ConnectWith(client, &bcnetgo.ClientHello{
+			Alias:     "Alice",
+			WantPeers: 10,
+		}, nil)
+		testinggo.AssertNoError(t, err)
+		if len(peers) != 0 {
+			t.Fatalf("Incorrect peers; expected none, got '%v'", peers)
+		}
+	})
+}
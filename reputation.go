@@ -0,0 +1,321 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_BAN_THRESHOLD       = 100
+	DEFAULT_BAN_DURATION        = time.Hour
+	DEFAULT_PERMANENT_BAN_AFTER = 3
+	DEFAULT_SCORE_TIMEOUT       = 24 * time.Hour
+	// MAX_REPUTATION_ENTRIES is the number of keys scored, once reached unbanned keys whose score is zero or has expired are discarded,
+	// then the least recently updated.
+	MAX_REPUTATION_ENTRIES = 10000
+)
+
+// Event is something a peer did which affects its reputation.
+type Event int
+
+const (
+	EVENT_SUCCESS Event = iota
+	EVENT_MALFORMED
+	EVENT_TOO_LARGE
+	EVENT_TIMEOUT
+	EVENT_WRONG_BLOCK
+	EVENT_REJECTED_BLOCK
+)
+
+func (e Event) String() string {
+	switch e {
+	case EVENT_SUCCESS:
+		return "Success"
+	case EVENT_MALFORMED:
+		return "Malformed"
+	case EVENT_TOO_LARGE:
+		return "Too Large"
+	case EVENT_TIMEOUT:
+		return "Timeout"
+	case EVENT_WRONG_BLOCK:
+		return "Wrong Block"
+	case EVENT_REJECTED_BLOCK:
+		return "Rejected Block"
+	}
+	return fmt.Sprintf("Event %d", int(e))
+}
+
+// DefaultPenalties maps each event to the amount it adds to a peer's score, successes reduce the score.
+var DefaultPenalties = map[Event]int{
+	EVENT_SUCCESS:        -10,
+	EVENT_MALFORMED:      20,
+	EVENT_TOO_LARGE:      20,
+	EVENT_TIMEOUT:        5,
+	EVENT_WRONG_BLOCK:    50,
+	EVENT_REJECTED_BLOCK: 10,
+}
+
+// ReputationEntry is the standing of a peer alias or remote IP.
+type ReputationEntry struct {
+	Score       int       `json:"score"`
+	Bans        int       `json:"bans"`
+	BannedUntil time.Time `json:"banned_until,omitempty"`
+	Permanent   bool      `json:"permanent,omitempty"`
+	Updated     time.Time `json:"updated,omitempty"`
+}
+
+// Banned returns true if the entry is banned at the given time.
+func (e ReputationEntry) Banned(now time.Time) bool {
+	return e.Permanent || now.Before(e.BannedUntil)
+}
+
+// Reputation scores peer aliases and remote IPs by the events observed by the handlers.
+// A key whose score reaches BanThreshold is banned for BanDuration, and permanently after PermanentBanAfter bans.
+// A score returns to zero once ScoreTimeout passes without an event for the key, zero means never.
+// Keys are only remembered while they have a score or ban, and at most MAX_REPUTATION_ENTRIES are kept.
+// If File is set, banned and scored entries are loaded from and saved to it as JSON, so bans persist across restarts.
+type Reputation struct {
+	Penalties         map[Event]int
+	BanThreshold      int
+	BanDuration       time.Duration
+	PermanentBanAfter int
+	ScoreTimeout      time.Duration
+	File              string
+
+	mutex   sync.Mutex
+	entries map[string]*ReputationEntry
+}
+
+// NewReputation returns a Reputation with the default penalties and thresholds, loading any entries saved in file.
+func NewReputation(file string) (*Reputation, error) {
+	r := &Reputation{
+		Penalties:         DefaultPenalties,
+		BanThreshold:      DEFAULT_BAN_THRESHOLD,
+		BanDuration:       DEFAULT_BAN_DURATION,
+		PermanentBanAfter: DEFAULT_PERMANENT_BAN_AFTER,
+		ScoreTimeout:      DEFAULT_SCORE_TIMEOUT,
+		File:              file,
+		entries:           make(map[string]*ReputationEntry),
+	}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		switch {
+		case os.IsNotExist(err):
+			// Nothing saved yet
+		case err != nil:
+			return nil, err
+		default:
+			if err := json.Unmarshal(data, &r.entries); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// Record applies the event to each key, banning any whose score reaches the threshold.
+func (r *Reputation) Record(event Event, keys ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	penalty := r.Penalties[event]
+	changed := false
+	for _, k := range keys {
+		e, ok := r.entries[k]
+		if !ok {
+			if penalty <= 0 {
+				// Score would stay at zero
+				continue
+			}
+			e = r.entry(k, now)
+		} else if r.expired(e, now) {
+			e.Score = 0
+		}
+		e.Score += penalty
+		if e.Score < 0 {
+			e.Score = 0
+		}
+		e.Updated = now
+		if r.BanThreshold > 0 && e.Score >= r.BanThreshold && !e.Banned(now) {
+			e.Score = 0
+			e.Bans++
+			if r.PermanentBanAfter > 0 && e.Bans >= r.PermanentBanAfter {
+				e.Permanent = true
+			} else {
+				e.BannedUntil = now.Add(r.BanDuration)
+			}
+			changed = true
+		}
+		if e.Score == 0 && e.Bans == 0 {
+			delete(r.entries, k)
+		}
+	}
+	if changed {
+		r.save()
+	}
+}
+
+// Banned returns true if any of the keys is banned.
+func (r *Reputation) Banned(keys ...string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	for _, k := range keys {
+		if e, ok := r.entries[k]; ok && e.Banned(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban bans the key for the given duration, or permanently if the duration is zero.
+func (r *Reputation) Ban(key string, duration time.Duration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	e := r.entry(key, now)
+	e.Bans++
+	e.Updated = now
+	if duration == 0 {
+		e.Permanent = true
+	} else {
+		e.BannedUntil = now.Add(duration)
+	}
+	return r.save()
+}
+
+// Unban lifts any ban on the key and clears its score.
+func (r *Reputation) Unban(key string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.entries, key)
+	return r.save()
+}
+
+// Entry returns the standing of the key.
+func (r *Reputation) Entry(key string) (ReputationEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	e, ok := r.entries[key]
+	if !ok {
+		return ReputationEntry{}, false
+	}
+	return *e, true
+}
+
+// Entries returns the standing of every key with a score or ban.
+func (r *Reputation) Entries() map[string]ReputationEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entries := make(map[string]ReputationEntry, len(r.entries))
+	for k, e := range r.entries {
+		entries[k] = *e
+	}
+	return entries
+}
+
+// Save writes the entries to File, if set.
+func (r *Reputation) Save() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.save()
+}
+
+func (r *Reputation) entry(key string, now time.Time) *ReputationEntry {
+	if r.entries == nil {
+		r.entries = make(map[string]*ReputationEntry)
+	}
+	e, ok := r.entries[key]
+	if !ok {
+		if len(r.entries) >= MAX_REPUTATION_ENTRIES {
+			r.prune(now)
+		}
+		e = &ReputationEntry{}
+		r.entries[key] = e
+	}
+	return e
+}
+
+// expired returns true if the entry's score has outlasted ScoreTimeout.
+func (r *Reputation) expired(e *ReputationEntry, now time.Time) bool {
+	return r.ScoreTimeout > 0 && now.Sub(e.Updated) >= r.ScoreTimeout
+}
+
+// prune discards unbanned entries whose score is zero or has expired,
+// or if none are, the least recently updated unbanned entry, or else the least recently updated temporary ban.
+func (r *Reputation) prune(now time.Time) {
+	var unbanned, banned string
+	var unbannedUpdated, bannedUpdated time.Time
+	for k, e := range r.entries {
+		switch {
+		case !e.Banned(now) && (e.Score == 0 || r.expired(e, now)):
+			delete(r.entries, k)
+		case !e.Banned(now):
+			if unbanned == "" || e.Updated.Before(unbannedUpdated) {
+				unbanned = k
+				unbannedUpdated = e.Updated
+			}
+		case !e.Permanent:
+			if banned == "" || e.Updated.Before(bannedUpdated) {
+				banned = k
+				bannedUpdated = e.Updated
+			}
+		}
+	}
+	if len(r.entries) < MAX_REPUTATION_ENTRIES {
+		return
+	}
+	if unbanned != "" {
+		delete(r.entries, unbanned)
+	} else if banned != "" {
+		delete(r.entries, banned)
+	}
+}
+
+// save writes the entries which are banned or have an unexpired score to File, if set.
+func (r *Reputation) save() error {
+	if r.File == "" {
+		return nil
+	}
+	now := time.Now()
+	entries := make(map[string]*ReputationEntry)
+	for k, e := range r.entries {
+		if e.Banned(now) || (e.Score > 0 && !r.expired(e, now)) {
+			entries[k] = e
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFile(r.File, data)
+}
+
+// writeFile replaces the file with the data, writing to a temporary file first so a crash cannot leave a partial file.
+func writeFile(file string, data []byte) error {
+	temp := file + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, file)
+}
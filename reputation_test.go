@@ -0,0 +1,212 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/channel"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReputation(t *testing.T) {
+	t.Run("Ban", func(t *testing.T) {
+		reputation, err := bcnetgo.NewReputation("")
+		testinggo.AssertNoError(t, err)
+		for i := 0; i < 4; i++ {
+			reputation.Record(bcnetgo.EVENT_MALFORMED, "Alice", "10.0.0.1")
+		}
+		if reputation.Banned("Alice") {
+			t.Fatal("Expected Alice not to be banned")
+		}
+		reputation.Record(bcnetgo.EVENT_MALFORMED, "Alice", "10.0.0.1")
+		if !reputation.Banned("Alice") || !reputation.Banned("10.0.0.1") {
+			t.Fatal("Expected Alice and 10.0.0.1 to be banned")
+		}
+		if reputation.Banned("Bob") {
+			t.Fatal("Expected Bob not to be banned")
+		}
+	})
+	t.Run("SuccessReducesScore", func(t *testing.T) {
+		reputation, err := bcnetgo.NewReputation("")
+		testinggo.AssertNoError(t, err)
+		reputation.Record(bcnetgo.EVENT_MALFORMED, "Alice")
+		reputation.Record(bcnetgo.EVENT_SUCCESS, "Alice")
+		e, ok := reputation.Entry("Alice")
+		if !ok {
+			t.Fatal("Expected entry")
+		}
+		if e.Score != 10 {
+			t.Fatalf("Incorrect score; expected '%d', got '%d'", 10, e.Score)
+		}
+	})
+	t.Run("NoEntryWithoutScore", func(t *testing.T) {
+		reputation, err := bcnetgo.NewReputation("")
+		testinggo.AssertNoError(t, err)
+		reputation.Record(bcnetgo.EVENT_SUCCESS, "Alice")
+		if _, ok := reputation.Entry("Alice"); ok {
+			t.Fatal("Expected no entry")
+		}
+		reputation.Record(bcnetgo.EVENT_TIMEOUT, "Alice")
+		reputation.Record(bcnetgo.EVENT_SUCCESS, "Alice")
+		if _, ok := reputation.Entry("Alice"); ok {
+			t.Fatal("Expected entry to be dropped once its score returns to zero")
+		}
+	})
+	t.Run("ScoreExpires", func(t *testing.T) {
+		reputation, err := bcnetgo.NewReputation("")
+		testinggo.AssertNoError(t, err)
+		reputation.ScoreTimeout = time.Millisecond
+		reputation.Record(bcnetgo.EVENT_MALFORMED, "Alice")
+		time.Sleep(2 * time.Millisecond)
+		reputation.Record(bcnetgo.EVENT_MALFORMED, "Alice")
+		e, _ := reputation.Entry("Alice")
+		if e.Score != 20 {
+			t.Fatalf("Incorrect score; expected '%d', got '%d'", 20, e.Score)
+		}
+	})
+	t.Run("Permanent", func(t *testing.T) {
+		reputation, err := bcnetgo.NewReputation("")
+		testinggo.AssertNoError(t, err)
+		reputation.BanDuration = time.Nanosecond
+		for i := 0; i < bcnetgo.DEFAULT_PERMANENT_BAN_AFTER; i++ {
+			time.Sleep(time.Millisecond)
+			reputation.Record(bcnetgo.EVENT_WRONG_BLOCK, "Alice")
+			reputation.Record(bcnetgo.EVENT_WRONG_BLOCK, "Alice")
+		}
+		time.Sleep(time.Millisecond)
+		e, _ := reputation.Entry("Alice")
+		if !e.Permanent || !reputation.Banned("Alice") {
+			t.Fatalf("Expected permanent ban, got '%+v'", e)
+		}
+	})
+	t.Run("Unban", func(t *testing.T) {
+		reputation, err := bcnetgo.NewReputation("")
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertNoError(t, reputation.Ban("Alice", 0))
+		if !reputation.Banned("Alice") {
+			t.Fatal("Expected Alice to be banned")
+		}
+		testinggo.AssertNoError(t, reputation.Unban("Alice"))
+		if reputation.Banned("Alice") {
+			t.Fatal("Expected Alice not to be banned")
+		}
+	})
+	t.Run("Persisted", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "reputation")
+		testinggo.AssertNoError(t, err)
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "reputation.json")
+
+		reputation, err := bcnetgo.NewReputation(file)
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertNoError(t, reputation.Ban("Alice", time.Hour))
+
+		reputation, err = bcnetgo.NewReputation(file)
+		testinggo.AssertNoError(t, err)
+		if !reputation.Banned("Alice") {
+			t.Fatal("Expected Alice to still be banned")
+		}
+
+		// Only banned and scored entries are saved
+		reputation.ScoreTimeout = time.Millisecond
+		reputation.Record(bcnetgo.EVENT_MALFORMED, "Bob")
+		time.Sleep(2 * time.Millisecond)
+		reputation.Record(bcnetgo.EVENT_MALFORMED, "Charlie")
+		testinggo.AssertNoError(t, reputation.Save())
+		reputation, err = bcnetgo.NewReputation(file)
+		testinggo.AssertNoError(t, err)
+		entries := reputation.Entries()
+		if _, ok := entries["Bob"]; ok {
+			t.Fatal("Expected expired score to not be saved")
+		}
+		if _, ok := entries["Charlie"]; !ok {
+			t.Fatal("Expected score to be saved")
+		}
+	})
+	t.Run("RequestTooLarge", func(t *testing.T) {
+		server := bcnetgo.NewServer(cache.NewMemory(10), nil, nil)
+		server.Reputation, _ = bcnetgo.NewReputation("")
+		server.MaxRequestSize = map[int]uint64{
+			network.PORT_GET_BLOCK: 8,
+		}
+		s, client := net.Pipe()
+		defer client.Close()
+		done := make(chan struct{})
+		go func() {
+			server.BlockPortTCPHandler(s)
+			close(done)
+		}()
+		go bcgo.WriteDelimitedProtobuf(bufio.NewWriter(client), &bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   []byte("FooBar123"),
+		})
+		bcgo.ReadDelimitedProtobuf(bufio.NewReader(client), &bcgo.Block{})
+		<-done
+
+		e, ok := server.Reputation.Entry("pipe")
+		if !ok || e.Score != bcnetgo.DefaultPenalties[bcnetgo.EVENT_TOO_LARGE] {
+			t.Fatalf("Incorrect score; expected '%d', got '%d'", bcnetgo.DefaultPenalties[bcnetgo.EVENT_TOO_LARGE], e.Score)
+		}
+	})
+	t.Run("KnownBlockNotRewarded", func(t *testing.T) {
+		source, hashes := makeChain(t, 1)
+		c := channel.New("Test")
+		server := bcnetgo.NewServer(cache.NewMemory(10), nil, func(string) (bcgo.Channel, error) {
+			return c, nil
+		})
+		server.Reputation, _ = bcnetgo.NewReputation("")
+		server.Reputation.Record(bcnetgo.EVENT_MALFORMED, "pipe")
+		expected := bcnetgo.DefaultPenalties[bcnetgo.EVENT_MALFORMED] + bcnetgo.DefaultPenalties[bcnetgo.EVENT_SUCCESS]
+
+		// Only the broadcast which updates the channel is rewarded
+		for i := 0; i < 2; i++ {
+			broadcast(t, server, source, hashes[0])
+		}
+		e, _ := server.Reputation.Entry("pipe")
+		if e.Score != expected {
+			t.Fatalf("Incorrect score; expected '%d', got '%d'", expected, e.Score)
+		}
+	})
+	t.Run("BannedAtAccept", func(t *testing.T) {
+		server := makeServer(t)
+		server.Reputation, _ = bcnetgo.NewReputation("")
+		testinggo.AssertNoError(t, server.Reputation.Ban("127.0.0.1", 0))
+		testinggo.AssertNoError(t, server.Start())
+		defer server.Shutdown(context.Background())
+
+		conn, err := net.Dial("tcp", server.Addr(network.PORT_GET_HEAD).String())
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Expected connection to be closed")
+		}
+		if got := server.Metrics().Banned; got != 1 {
+			t.Fatalf("Incorrect banned count; expected '%d', got '%d'", 1, got)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/cryptogo"
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"net"
+)
+
+const (
+	DEFAULT_MAX_SNAPSHOT_BLOCKS = 100000
+	MAX_SNAPSHOT_BATCH_SIZE     = 4 * 1024 * 1024 // 4Mb
+)
+
+// writeSnapshot writes the requested range of blocks in batches of up to MAX_SNAPSHOT_BATCH_SIZE,
+// or of a single block if it is larger. If MaxSnapshotBlocks is reached first, the final Response references the next block,
+// so the client can request the rest.
+func (s *Server) writeSnapshot(writer *bufio.Writer, request *Request) error {
+	batch := &Response{}
+	size := 0
+	first := true
+	next, response := s.walkBlocks(request, s.MaxSnapshotBlocks, func(hash []byte, block *bcgo.Block) error {
+		data, err := proto.Marshal(block)
+		if err != nil {
+			return err
+		}
+		if len(batch.Blocks) > 0 && size+len(data) > MAX_SNAPSHOT_BATCH_SIZE {
+			if err := WriteDelimitedMessage(writer, batch); err != nil {
+				return err
+			}
+			batch = &Response{}
+			size = 0
+		}
+		if first {
+			// First batch references the newest block
+			batch.Reference = &bcgo.Reference{
+				Timestamp:   block.Timestamp,
+				ChannelName: block.ChannelName,
+				BlockHash:   hash,
+			}
+			first = false
+		}
+		batch.Blocks = append(batch.Blocks, block)
+		size += len(data)
+		return nil
+	})
+	if response != nil {
+		return WriteDelimitedMessage(writer, response)
+	}
+	if len(batch.Blocks) > 0 {
+		if err := WriteDelimitedMessage(writer, batch); err != nil {
+			return err
+		}
+	}
+	end := &Response{
+		End: true,
+	}
+	if len(next) > 0 {
+		end.Reference = &bcgo.Reference{
+			ChannelName: request.Reference.ChannelName,
+			BlockHash:   next,
+		}
+	}
+	return WriteDelimitedMessage(writer, end)
+}
+
+// ErrSnapshotTruncated is returned by Snapshot when the server stopped before the requested range ended,
+// the rest can be requested from Next.
+type ErrSnapshotTruncated struct {
+	Next *bcgo.Reference
+}
+
+func (e ErrSnapshotTruncated) Error() string {
+	return "Snapshot truncated"
+}
+
+// Snapshot requests a snapshot of a channel from a connection to the get block port, starting at the referenced block,
+// or the channel head if the reference has no block hash, and walking back until request.Limit blocks are received,
+// the block hash equals request.Until, such as a checkpoint the receiver already holds, or the genesis block is reached.
+// If request.Limit is zero it is set to DEFAULT_MAX_SNAPSHOT_BLOCKS.
+// Every block is checked to hash to the expected value and to belong to the channel, and each batch is put in the cache,
+// oldest first, once checked, so at most one batch is held in memory. The channel head in the cache is not updated,
+// the reference to the newest block is returned so the caller can update the channel once the snapshot is complete.
+// If the server stops early the reference is returned with ErrSnapshotTruncated, so the caller can resume from its Next block
+// on a new connection with the same Until.
+func Snapshot(conn net.Conn, cache bcgo.Cache, request *Request) (*bcgo.Reference, error) {
+	if request.Reference == nil {
+		return nil, errors.New("Missing reference")
+	}
+	request.Snapshot = true
+	if request.Limit == 0 {
+		request.Limit = DEFAULT_MAX_SNAPSHOT_BLOCKS
+	}
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if err := WritePreamble(writer, PROTOCOL_VERSION); err != nil {
+		return nil, err
+	}
+	if err := WriteDelimitedMessage(writer, request); err != nil {
+		return nil, err
+	}
+	channel := request.Reference.ChannelName
+	var head *bcgo.Reference
+	var next *bcgo.Reference
+	count := uint64(0)
+	expected := request.Reference.BlockHash
+	for {
+		response, err := readResponse(reader)
+		if err != nil {
+			return nil, err
+		}
+		if response.End {
+			next = response.Reference
+			break
+		}
+		if head == nil {
+			if response.Reference == nil {
+				return nil, errors.New("Missing reference")
+			}
+			if len(expected) > 0 && !bytes.Equal(expected, response.Reference.BlockHash) {
+				return nil, errors.New("Got wrong head from server")
+			}
+			head = response.Reference
+			expected = head.BlockHash
+		}
+		hashes := make([][]byte, len(response.Blocks))
+		for i, block := range response.Blocks {
+			if count >= request.Limit {
+				return nil, errors.New("Too many blocks")
+			}
+			hash, err := cryptogo.HashProtobuf(block)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(hash, expected) || block.ChannelName != channel {
+				return nil, errors.New("Got wrong block from server")
+			}
+			hashes[i] = hash
+			expected = block.Previous
+			count++
+		}
+		for i := len(hashes) - 1; i >= 0; i-- {
+			if err := cache.PutBlock(hashes[i], response.Blocks[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if head == nil {
+		if len(request.Until) == 0 {
+			return nil, errors.New("Empty snapshot")
+		}
+		// Nothing newer than the checkpoint
+		return &bcgo.Reference{
+			ChannelName: channel,
+			BlockHash:   request.Until,
+		}, nil
+	}
+	// The snapshot must end at the limit, the checkpoint, or the genesis block, unless the server says where it continues
+	switch {
+	case len(expected) == 0:
+	case len(request.Until) > 0 && bytes.Equal(expected, request.Until):
+	case count == request.Limit:
+	case next != nil && bytes.Equal(expected, next.BlockHash):
+		return head, ErrSnapshotTruncated{
+			Next: next,
+		}
+	default:
+		return nil, errors.New("Incomplete snapshot")
+	}
+	return head, nil
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	source, hashes := makeChain(t, 5)
+	server := bcnetgo.NewServer(source, nil, nil)
+	snapshot := func(request *bcnetgo.Request) (bcgo.Cache, *bcgo.Reference, error) {
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BlockPortTCPHandler(s)
+		destination := cache.NewMemory(10)
+		head, err := bcnetgo.Snapshot(client, destination, request)
+		return destination, head, err
+	}
+	// expectBlocks fails unless the cache holds exactly the given blocks
+	expectBlocks := func(t *testing.T, c bcgo.Cache, present [][]byte, absent [][]byte) {
+		t.Helper()
+		for _, h := range present {
+			if _, err := c.Block(h); err != nil {
+				t.Fatalf("Expected block '%x': %v", h, err)
+			}
+		}
+		for _, h := range absent {
+			if _, err := c.Block(h); err == nil {
+				t.Fatalf("Expected no block '%x'", h)
+			}
+		}
+	}
+	t.Run("Genesis", func(t *testing.T) {
+		c, head, err := snapshot(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+		})
+		testinggo.AssertNoError(t, err)
+		if !bytes.Equal(head.BlockHash, hashes[0]) {
+			t.Fatalf("Incorrect head; expected '%x', got '%x'", hashes[0], head.BlockHash)
+		}
+		expectBlocks(t, c, hashes, nil)
+	})
+	t.Run("Depth", func(t *testing.T) {
+		c, _, err := snapshot(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+			Limit: 2,
+		})
+		testinggo.AssertNoError(t, err)
+		expectBlocks(t, c, hashes[:2], hashes[2:])
+	})
+	t.Run("Checkpoint", func(t *testing.T) {
+		c, _, err := snapshot(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+			Until: hashes[3],
+		})
+		testinggo.AssertNoError(t, err)
+		expectBlocks(t, c, hashes[:3], hashes[3:])
+	})
+	t.Run("UpToDate", func(t *testing.T) {
+		_, head, err := snapshot(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+			Until: hashes[0],
+		})
+		testinggo.AssertNoError(t, err)
+		if !bytes.Equal(head.BlockHash, hashes[0]) {
+			t.Fatalf("Incorrect head; expected '%x', got '%x'", hashes[0], head.BlockHash)
+		}
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		server.MaxSnapshotBlocks = 2
+		defer func() {
+			server.MaxSnapshotBlocks = bcnetgo.DEFAULT_MAX_SNAPSHOT_BLOCKS
+		}()
+		c, head, err := snapshot(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+		})
+		e, ok := err.(bcnetgo.ErrSnapshotTruncated)
+		if !ok {
+			t.Fatalf("Incorrect error; expected ErrSnapshotTruncated, got '%v'", err)
+		}
+		if !bytes.Equal(head.BlockHash, hashes[0]) {
+			t.Fatalf("Incorrect head; expected '%x', got '%x'", hashes[0], head.BlockHash)
+		}
+		if !bytes.Equal(e.Next.BlockHash, hashes[2]) {
+			t.Fatalf("Incorrect next; expected '%x', got '%x'", hashes[2], e.Next.BlockHash)
+		}
+		expectBlocks(t, c, hashes[:2], hashes[2:])
+
+		// Resume from the next block
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BlockPortTCPHandler(s)
+		_, err = bcnetgo.Snapshot(client, c, &bcnetgo.Request{
+			Reference: e.Next,
+		})
+		if _, ok := err.(bcnetgo.ErrSnapshotTruncated); !ok {
+			t.Fatalf("Incorrect error; expected ErrSnapshotTruncated, got '%v'", err)
+		}
+		expectBlocks(t, c, hashes[:4], hashes[4:])
+	})
+	t.Run("Incomplete", func(t *testing.T) {
+		s, client := net.Pipe()
+		defer client.Close()
+		// Server ends the snapshot early without saying where it continues
+		go func() {
+			reader := bufio.NewReader(s)
+			writer := bufio.NewWriter(s)
+			bcnetgo.ReadPreamble(reader)
+			bcnetgo.ReadDelimitedMessage(reader, &bcnetgo.Request{}, bcnetgo.DEFAULT_MAX_REFERENCE_SIZE)
+			block, _ := source.Block(hashes[0])
+			bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.Response{
+				Reference: &bcgo.Reference{
+					ChannelName: "Test",
+					BlockHash:   hashes[0],
+				},
+				Blocks: []*bcgo.Block{block},
+			})
+			bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.Response{
+				End: true,
+			})
+		}()
+		if _, err := bcnetgo.Snapshot(client, cache.NewMemory(10), &bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+		}); err == nil || err.Error() != "Incomplete snapshot" {
+			t.Fatalf("Incorrect error; expected 'Incomplete snapshot', got '%v'", err)
+		}
+	})
+	t.Run("TooManyBlocks", func(t *testing.T) {
+		s, client := net.Pipe()
+		defer client.Close()
+		// Server sends more blocks than requested
+		go func() {
+			reader := bufio.NewReader(s)
+			writer := bufio.NewWriter(s)
+			bcnetgo.ReadPreamble(reader)
+			bcnetgo.ReadDelimitedMessage(reader, &bcnetgo.Request{}, bcnetgo.DEFAULT_MAX_REFERENCE_SIZE)
+			var blocks []*bcgo.Block
+			for _, h := range hashes[:2] {
+				block, _ := source.Block(h)
+				blocks = append(blocks, block)
+			}
+			bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.Response{
+				Reference: &bcgo.Reference{
+					ChannelName: "Test",
+					BlockHash:   hashes[0],
+				},
+				Blocks: blocks,
+			})
+		}()
+		if _, err := bcnetgo.Snapshot(client, cache.NewMemory(10), &bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+			Limit: 1,
+		}); err == nil || err.Error() != "Too many blocks" {
+			t.Fatalf("Incorrect error; expected 'Too many blocks', got '%v'", err)
+		}
+	})
+	t.Run("WrongBlock", func(t *testing.T) {
+		s, client := net.Pipe()
+		defer client.Close()
+		// Server replies with a block that does not match the reference
+		go func() {
+			reader := bufio.NewReader(s)
+			writer := bufio.NewWriter(s)
+			bcnetgo.ReadPreamble(reader)
+			bcnetgo.ReadDelimitedMessage(reader, &bcnetgo.Request{}, bcnetgo.DEFAULT_MAX_REFERENCE_SIZE)
+			block, _ := source.Block(hashes[1])
+			bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.Response{
+				Reference: &bcgo.Reference{
+					ChannelName: "Test",
+					BlockHash:   hashes[0],
+				},
+				Blocks: []*bcgo.Block{block},
+			})
+		}()
+		c := cache.NewMemory(10)
+		if _, err := bcnetgo.Snapshot(client, c, &bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+		}); err == nil || err.Error() != "Got wrong block from server" {
+			t.Fatalf("Incorrect error; expected 'Got wrong block from server', got '%v'", err)
+		}
+		expectBlocks(t, c, nil, hashes)
+	})
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/bcgo"
+	"bufio"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_SUBSCRIPTIONS    = 100
+	DEFAULT_HEARTBEAT_INTERVAL   = 30 * time.Second
+	DEFAULT_SUBSCRIPTION_TIMEOUT = time.Hour
+)
+
+// subscription holds the latest head of each changed channel until it is written to the subscriber.
+type subscription struct {
+	mutex   sync.Mutex
+	pending map[string]*bcgo.Reference
+	order   []string
+	signal  chan struct{}
+}
+
+func (s *subscription) push(reference *bcgo.Reference) {
+	s.mutex.Lock()
+	if _, ok := s.pending[reference.ChannelName]; !ok {
+		s.order = append(s.order, reference.ChannelName)
+	}
+	s.pending[reference.ChannelName] = reference
+	s.mutex.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+		// Subscriber already signalled
+	}
+}
+
+func (s *subscription) pop() []*bcgo.Reference {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var references []*bcgo.Reference
+	for _, c := range s.order {
+		references = append(references, s.pending[c])
+	}
+	s.pending = make(map[string]*bcgo.Reference)
+	s.order = nil
+	return references
+}
+
+// subscribe writes the head of each requested channel, then writes each new head as the channels are updated,
+// with a heartbeat after every HeartbeatInterval without an update, until the client disconnects, the server shuts down,
+// or SubscriptionTimeout elapses.
+func (s *Server) subscribe(address string, conn net.Conn, writer *bufio.Writer, version uint64, request *Request) {
+	channels := request.ChannelNames()
+	if len(channels) == 0 {
+		writeResponse(writer, version, &Response{
+			Status:  STATUS_BAD_REQUEST,
+			Message: "Missing channels",
+		})
+		return
+	}
+	if s.MaxSubscriptions > 0 && len(channels) > s.MaxSubscriptions {
+		log.Println(address, "Too many subscriptions", len(channels))
+		writeResponse(writer, version, &Response{
+			Status:  STATUS_TOO_LARGE,
+			Message: "Too many subscriptions",
+		})
+		return
+	}
+
+	sub := &subscription{
+		pending: make(map[string]*bcgo.Reference),
+		signal:  make(chan struct{}, 1),
+	}
+	var subscribed []string
+	var responses []*Response
+	for _, c := range channels {
+		if !s.canRead(conn, c) {
+			responses = append(responses, forbiddenResponse(c))
+			continue
+		}
+		subscribed = append(subscribed, c)
+	}
+	// Register before reading the heads so no update is missed
+	s.addSubscription(subscribed, sub)
+	defer s.removeSubscription(subscribed, sub)
+	for _, c := range subscribed {
+		responses = append(responses, s.headResponse(&bcgo.Reference{
+			ChannelName: c,
+		}))
+	}
+	for _, r := range responses {
+		if err := writeResponse(writer, version, r); err != nil {
+			log.Println(address, err)
+			return
+		}
+	}
+	log.Println(address, "Subscribed", subscribed)
+
+	// Subscriptions outlive the session timeout, ending instead after the subscription timeout
+	if c, ok := conn.(*timeoutConn); ok {
+		c.session = time.Time{}
+	}
+	var timeout <-chan time.Time
+	if s.SubscriptionTimeout > 0 {
+		timer := time.NewTimer(s.SubscriptionTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	heartbeat := s.HeartbeatInterval
+	if heartbeat <= 0 {
+		heartbeat = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		var responses []*Response
+		select {
+		case <-sub.signal:
+			for _, r := range sub.pop() {
+				responses = append(responses, &Response{
+					Reference: r,
+				})
+			}
+		case <-ticker.C:
+			responses = append(responses, &Response{
+				Heartbeat: true,
+			})
+		case <-timeout:
+			writeResponse(writer, version, &Response{
+				End: true,
+			})
+			return
+		case <-s.stopped:
+			writeResponse(writer, version, &Response{
+				End: true,
+			})
+			return
+		}
+		for _, r := range responses {
+			if err := writeResponse(writer, version, r); err != nil {
+				log.Println(address, err)
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) addSubscription(channels []string, sub *subscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range channels {
+		subs, ok := s.subscriptions[c]
+		if !ok {
+			subs = make(map[*subscription]bool)
+			s.subscriptions[c] = subs
+		}
+		subs[sub] = true
+	}
+}
+
+func (s *Server) removeSubscription(channels []string, sub *subscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range channels {
+		delete(s.subscriptions[c], sub)
+		if len(s.subscriptions[c]) == 0 {
+			delete(s.subscriptions, c)
+		}
+	}
+}
+
+// publishHead notifies the subscribers of the channel that its head changed.
+func (s *Server) publishHead(reference *bcgo.Reference) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for sub := range s.subscriptions[reference.ChannelName] {
+		sub.push(reference)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/channel"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	source, hashes := makeChain(t, 2)
+	makeSubscriptionServer := func(t *testing.T) *bcnetgo.Server {
+		t.Helper()
+		c := channel.New("Test")
+		return bcnetgo.NewServer(cache.NewMemory(10), makeNetwork(t), func(string) (bcgo.Channel, error) {
+			return c, nil
+		})
+	}
+	// subscribe subscribes to the channels on the server, and returns a channel receiving each response
+	subscribe := func(t *testing.T, server *bcnetgo.Server, channels ...string) (chan *bcnetgo.Response, chan error) {
+		t.Helper()
+		s, client := net.Pipe()
+		go server.HeadPortTCPHandler(s)
+		responses := make(chan *bcnetgo.Response, 10)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- bcnetgo.Subscribe(client, channels, func(response *bcnetgo.Response) error {
+				responses <- response
+				return nil
+			})
+			client.Close()
+		}()
+		return responses, errs
+	}
+	expectResponse := func(t *testing.T, responses chan *bcnetgo.Response) *bcnetgo.Response {
+		t.Helper()
+		select {
+		case response := <-responses:
+			return response
+		case <-time.After(time.Second):
+			t.Fatal("Expected response")
+		}
+		return nil
+	}
+	t.Run("HeadChanged", func(t *testing.T) {
+		server := makeSubscriptionServer(t)
+		responses, errs := subscribe(t, server, "Test")
+
+		// Channel has no head yet
+		response := expectResponse(t, responses)
+		if response.Status != bcnetgo.STATUS_NOT_FOUND {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_NOT_FOUND, response.Status)
+		}
+
+		broadcast(t, server, source, hashes[0])
+		response = expectResponse(t, responses)
+		if response.Reference == nil || !bytes.Equal(response.Reference.BlockHash, hashes[0]) {
+			t.Fatalf("Incorrect head; expected '%v', got '%v'", hashes[0], response.Reference)
+		}
+
+		testinggo.AssertNoError(t, server.Shutdown(context.Background()))
+		testinggo.AssertNoError(t, <-errs)
+	})
+	t.Run("Heartbeat", func(t *testing.T) {
+		server := makeSubscriptionServer(t)
+		server.HeartbeatInterval = time.Millisecond
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.HeadPortTCPHandler(s)
+		reader := bufio.NewReader(client)
+		writer := bufio.NewWriter(client)
+		testinggo.AssertNoError(t, bcnetgo.WritePreamble(writer, bcnetgo.PROTOCOL_VERSION))
+		testinggo.AssertNoError(t, bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.Request{
+			Subscribe: true,
+			Channels:  []string{"Test"},
+		}))
+		// Skip the current head
+		response := &bcnetgo.Response{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(reader, response, bcnetgo.DEFAULT_MAX_BLOCK_SIZE))
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(reader, response, bcnetgo.DEFAULT_MAX_BLOCK_SIZE))
+		if !response.Heartbeat {
+			t.Fatalf("Expected heartbeat, got '%+v'", response)
+		}
+	})
+	t.Run("Timeout", func(t *testing.T) {
+		server := makeSubscriptionServer(t)
+		server.SubscriptionTimeout = 10 * time.Millisecond
+		_, errs := subscribe(t, server, "Test")
+		select {
+		case err := <-errs:
+			testinggo.AssertNoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Expected subscription to end")
+		}
+	})
+	t.Run("TooMany", func(t *testing.T) {
+		server := makeSubscriptionServer(t)
+		server.MaxSubscriptions = 1
+		responses, errs := subscribe(t, server, "Foo", "Bar")
+		response := expectResponse(t, responses)
+		if response.Status != bcnetgo.STATUS_TOO_LARGE {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_TOO_LARGE, response.Status)
+		}
+		if err := <-errs; err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+	t.Run("Forbidden", func(t *testing.T) {
+		server := makeSubscriptionServer(t)
+		server.Policy = &bcnetgo.AccessList{
+			Readers: map[string][]string{
+				"Secret": {"Alice"},
+			},
+		}
+		responses, _ := subscribe(t, server, "Secret")
+		response := expectResponse(t, responses)
+		if response.Status != bcnetgo.STATUS_FORBIDDEN {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_FORBIDDEN, response.Status)
+		}
+		testinggo.AssertNoError(t, server.Shutdown(context.Background()))
+	})
+}
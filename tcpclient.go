@@ -0,0 +1,265 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/cryptogo"
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+)
+
+// RequestBlock requests a block by hash, or by the hash of a record it contains, from a connection to the get block port.
+// An ErrStatus is returned if the server could not provide the block.
+func RequestBlock(conn net.Conn, reference *bcgo.Reference) (*bcgo.Block, error) {
+	response, err := request(conn, &Request{
+		Reference: reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.Block == nil {
+		return nil, errors.New("Missing block")
+	}
+	return response.Block, nil
+}
+
+// ErrRangeTruncated is returned by RequestBlocks when the server stopped before the requested range ended,
+// the rest can be requested from Next.
+type ErrRangeTruncated struct {
+	Next *bcgo.Reference
+}
+
+func (e ErrRangeTruncated) Error() string {
+	return "Range truncated"
+}
+
+// RequestBlocks requests a range of blocks from a connection to the get block port,
+// and calls callback with each block, newest first, after checking it hashes to the expected value.
+// An ErrStatus is returned if the server could not provide the whole range,
+// or ErrRangeTruncated if the server's limit stopped it early.
+func RequestBlocks(conn net.Conn, request *Request, callback func([]byte, *bcgo.Block) error) error {
+	if request.Reference == nil {
+		return errors.New("Missing reference")
+	}
+	if !request.IsRange() {
+		return errors.New("Missing limit or until")
+	}
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if err := WritePreamble(writer, PROTOCOL_VERSION); err != nil {
+		return err
+	}
+	if err := WriteDelimitedMessage(writer, request); err != nil {
+		return err
+	}
+	expected := request.Reference.BlockHash
+	var count uint64
+	for {
+		response, err := readResponse(reader)
+		if err != nil {
+			return err
+		}
+		if response.End {
+			if response.Reference == nil {
+				return nil
+			}
+			if !bytes.Equal(response.Reference.BlockHash, expected) {
+				return errors.New("Got wrong next block from server")
+			}
+			return ErrRangeTruncated{
+				Next: response.Reference,
+			}
+		}
+		if response.Block == nil || response.Reference == nil {
+			return errors.New("Missing block")
+		}
+		count++
+		if request.Limit > 0 && count > request.Limit {
+			return errors.New("Too many blocks")
+		}
+		hash, err := cryptogo.HashProtobuf(response.Block)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, response.Reference.BlockHash) || ((count > 1 || len(expected) > 0) && !bytes.Equal(hash, expected)) {
+			return errors.New("Got wrong block from server")
+		}
+		if err := callback(hash, response.Block); err != nil {
+			return err
+		}
+		expected = response.Block.Previous
+	}
+}
+
+// Broadcast sends a block to a connection to the broadcast port, answering requests for missing ancestors from the cache,
+// and returns the server's final response holding the outcome, the reason for any rejection, and the channel's head.
+// An ErrStatus is returned if the server could not process the broadcast.
+func Broadcast(conn net.Conn, cache bcgo.Cache, block *bcgo.Block) (*Response, error) {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if err := WritePreamble(writer, PROTOCOL_VERSION); err != nil {
+		return nil, err
+	}
+	if err := bcgo.WriteDelimitedProtobuf(writer, block); err != nil {
+		return nil, err
+	}
+	for {
+		response := &Response{}
+		if err := ReadDelimitedMessage(reader, response, DEFAULT_MAX_BLOCK_SIZE); err != nil {
+			return nil, err
+		}
+		if response.Missing == nil {
+			if response.Status != STATUS_OK && response.Outcome == OUTCOME_UNKNOWN {
+				return nil, ErrStatus{
+					Status:  response.Status,
+					Message: response.Message,
+				}
+			}
+			return response, nil
+		}
+		b, err := cache.Block(response.Missing.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		if err := bcgo.WriteDelimitedProtobuf(writer, b); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// broadcastLegacy sends a block to a legacy peer, which replies with a bare Reference to either a missing block or its head.
+func broadcastLegacy(conn net.Conn, cache bcgo.Cache, hash []byte, block *bcgo.Block) error {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if err := bcgo.WriteDelimitedProtobuf(writer, block); err != nil {
+		return err
+	}
+	for {
+		reference := &bcgo.Reference{}
+		if err := ReadDelimitedProtobuf(reader, reference, DEFAULT_MAX_REFERENCE_SIZE); err != nil {
+			return err
+		}
+		if bytes.Equal(reference.BlockHash, hash) {
+			// Peer accepted block as head
+			return nil
+		}
+		b, err := cache.Block(reference.BlockHash)
+		if err != nil {
+			return err
+		}
+		if err := bcgo.WriteDelimitedProtobuf(writer, b); err != nil {
+			return err
+		}
+	}
+}
+
+// RequestHead requests the head of a channel from a connection to the get head port.
+// An ErrStatus is returned if the server could not provide the head.
+func RequestHead(conn net.Conn, channel string) (*bcgo.Reference, error) {
+	response, err := request(conn, &Request{
+		Reference: &bcgo.Reference{
+			ChannelName: channel,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.Reference == nil {
+		return nil, errors.New("Missing reference")
+	}
+	return response.Reference, nil
+}
+
+// RequestHeads requests the heads of the given channels, and of the channels whose names start with prefix,
+// from a connection to the get head port. Each head is returned as a Response holding the Status of one channel,
+// and a Reference naming the channel, with its head if successful.
+// An ErrStatus is returned if the server could not answer the request as a whole.
+func RequestHeads(conn net.Conn, channels []string, prefix string) ([]*Response, error) {
+	if len(channels) == 0 && prefix == "" {
+		return nil, errors.New("Missing channels or prefix")
+	}
+	response, err := request(conn, &Request{
+		Channels: channels,
+		Prefix:   prefix,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.Heads, nil
+}
+
+// Subscribe subscribes to the heads of the given channels from a connection to the get head port,
+// and calls callback with the current head of each channel, then with each new head as the channels are updated.
+// A channel which could not be subscribed to is passed to callback as a Response with an unsuccessful Status.
+// Subscribe returns when the server ends the subscription, the connection fails, or callback returns an error.
+func Subscribe(conn net.Conn, channels []string, callback func(*Response) error) error {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if err := WritePreamble(writer, PROTOCOL_VERSION); err != nil {
+		return err
+	}
+	if err := WriteDelimitedMessage(writer, &Request{
+		Subscribe: true,
+		Channels:  channels,
+	}); err != nil {
+		return err
+	}
+	for {
+		response := &Response{}
+		if err := ReadDelimitedMessage(reader, response, DEFAULT_MAX_BLOCK_SIZE); err != nil {
+			return err
+		}
+		switch {
+		case response.End:
+			return nil
+		case response.Heartbeat:
+			continue
+		}
+		if err := callback(response); err != nil {
+			return err
+		}
+	}
+}
+
+func request(conn net.Conn, request *Request) (*Response, error) {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if err := WritePreamble(writer, PROTOCOL_VERSION); err != nil {
+		return nil, err
+	}
+	if err := WriteDelimitedMessage(writer, request); err != nil {
+		return nil, err
+	}
+	return readResponse(reader)
+}
+
+func readResponse(reader *bufio.Reader) (*Response, error) {
+	response := &Response{}
+	if err := ReadDelimitedMessage(reader, response, DEFAULT_MAX_BLOCK_SIZE); err != nil {
+		return nil, err
+	}
+	if response.Status != STATUS_OK {
+		return nil, ErrStatus{
+			Status:  response.Status,
+			Message: response.Message,
+		}
+	}
+	return response, nil
+}
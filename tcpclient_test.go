@@ -0,0 +1,446 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/channel"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/cryptogo"
+	"aletheiaware.com/testinggo"
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func makeCache(t *testing.T) (bcgo.Cache, []byte, *bcgo.Block) {
+	t.Helper()
+	block := &bcgo.Block{
+		Timestamp:   1234,
+		ChannelName: "Test",
+		Length:      1,
+		Entry: []*bcgo.BlockEntry{
+			{
+				RecordHash: []byte("Record123"),
+				Record:     &bcgo.Record{},
+			},
+		},
+	}
+	hash, err := cryptogo.HashProtobuf(block)
+	testinggo.AssertNoError(t, err)
+	cache := cache.NewMemory(10)
+	cache.PutBlock(hash, block)
+	cache.PutHead("Test", &bcgo.Reference{
+		Timestamp:   1234,
+		ChannelName: "Test",
+		BlockHash:   hash,
+	})
+	return cache, hash, block
+}
+
+// makeChain returns a cache holding a channel of the given length, and the hashes of its blocks from the head back.
+func makeChain(t *testing.T, length int) (bcgo.Cache, [][]byte) {
+	t.Helper()
+	cache := cache.NewMemory(length)
+	var hashes [][]byte
+	var previous []byte
+	for i := 1; i <= length; i++ {
+		block := &bcgo.Block{
+			Timestamp:   uint64(i),
+			ChannelName: "Test",
+			Length:      uint64(i),
+			Previous:    previous,
+		}
+		hash, err := cryptogo.HashProtobuf(block)
+		testinggo.AssertNoError(t, err)
+		cache.PutBlock(hash, block)
+		hashes = append([][]byte{hash}, hashes...)
+		previous = hash
+	}
+	cache.PutHead("Test", &bcgo.Reference{
+		Timestamp:   uint64(length),
+		ChannelName: "Test",
+		BlockHash:   previous,
+	})
+	return cache, hashes
+}
+
+// expectStatus fails unless err is an ErrStatus with the given status.
+func expectStatus(t *testing.T, expected bcnetgo.Status, err error) {
+	t.Helper()
+	if e, ok := err.(bcnetgo.ErrStatus); !ok {
+		t.Fatalf("Incorrect error; expected ErrStatus, got '%v'", err)
+	} else if e.Status != expected {
+		t.Fatalf("Incorrect status; expected '%s', got '%s'", expected, e.Status)
+	}
+}
+
+func TestRequestBlock(t *testing.T) {
+	cache, hash, block := makeCache(t)
+	server := bcnetgo.NewServer(cache, nil, nil)
+	server.MaxRequestSize = map[int]uint64{
+		network.PORT_GET_BLOCK: 512,
+	}
+	request := func(reference *bcgo.Reference) (*bcgo.Block, error) {
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BlockPortTCPHandler(s)
+		return bcnetgo.RequestBlock(client, reference)
+	}
+	t.Run("BlockExists", func(t *testing.T) {
+		got, err := request(&bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   hash,
+		})
+		testinggo.AssertNoError(t, err)
+		if block.String() != got.String() {
+			t.Fatalf("Incorrect block; expected '%s', got '%s'", block.String(), got.String())
+		}
+	})
+	t.Run("BlockNotExists", func(t *testing.T) {
+		_, err := request(&bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   []byte("FooBar123"),
+		})
+		expectStatus(t, bcnetgo.STATUS_NOT_FOUND, err)
+	})
+	t.Run("RecordExists", func(t *testing.T) {
+		got, err := request(&bcgo.Reference{
+			ChannelName: "Test",
+			RecordHash:  []byte("Record123"),
+		})
+		testinggo.AssertNoError(t, err)
+		if block.String() != got.String() {
+			t.Fatalf("Incorrect block; expected '%s', got '%s'", block.String(), got.String())
+		}
+	})
+	t.Run("RecordNotExists", func(t *testing.T) {
+		_, err := request(&bcgo.Reference{
+			ChannelName: "Test",
+			RecordHash:  []byte("FooBar123"),
+		})
+		expectStatus(t, bcnetgo.STATUS_NOT_FOUND, err)
+	})
+	t.Run("RecordIndexed", func(t *testing.T) {
+		index := bcnetgo.NewMemoryRecordIndex()
+		testinggo.AssertNoError(t, bcnetgo.RebuildRecordIndex(index, cache, "Test"))
+		server := bcnetgo.NewServer(cache, nil, nil)
+		server.Index = index
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BlockPortTCPHandler(s)
+		got, err := bcnetgo.RequestBlock(client, &bcgo.Reference{
+			ChannelName: "Test",
+			RecordHash:  []byte("Record123"),
+		})
+		testinggo.AssertNoError(t, err)
+		if block.String() != got.String() {
+			t.Fatalf("Incorrect block; expected '%s', got '%s'", block.String(), got.String())
+		}
+	})
+	t.Run("RecordNotIndexed", func(t *testing.T) {
+		server := bcnetgo.NewServer(cache, nil, nil)
+		server.Index = bcnetgo.NewMemoryRecordIndex()
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BlockPortTCPHandler(s)
+		_, err := bcnetgo.RequestBlock(client, &bcgo.Reference{
+			ChannelName: "Test",
+			RecordHash:  []byte("Record123"),
+		})
+		expectStatus(t, bcnetgo.STATUS_NOT_FOUND, err)
+	})
+	t.Run("RecordIndexedCache", func(t *testing.T) {
+		// Index is taken from the cache, and caught up with the head already in it
+		server := bcnetgo.NewServer(bcnetgo.NewIndexedCache(cache, bcnetgo.NewMemoryRecordIndex()), nil, nil)
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BlockPortTCPHandler(s)
+		got, err := bcnetgo.RequestBlock(client, &bcgo.Reference{
+			ChannelName: "Test",
+			RecordHash:  []byte("Record123"),
+		})
+		testinggo.AssertNoError(t, err)
+		if block.String() != got.String() {
+			t.Fatalf("Incorrect block; expected '%s', got '%s'", block.String(), got.String())
+		}
+	})
+	t.Run("MissingHash", func(t *testing.T) {
+		_, err := request(&bcgo.Reference{
+			ChannelName: "Test",
+		})
+		expectStatus(t, bcnetgo.STATUS_BAD_REQUEST, err)
+	})
+	t.Run("TooLarge", func(t *testing.T) {
+		_, err := request(&bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   make([]byte, 1024),
+		})
+		expectStatus(t, bcnetgo.STATUS_TOO_LARGE, err)
+	})
+}
+
+func TestRequestBlocks(t *testing.T) {
+	cache, hashes := makeChain(t, 5)
+	server := bcnetgo.NewServer(cache, nil, nil)
+	server.MaxRangeBlocks = 4
+	request := func(request *bcnetgo.Request) ([][]byte, error) {
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BlockPortTCPHandler(s)
+		var got [][]byte
+		err := bcnetgo.RequestBlocks(client, request, func(hash []byte, block *bcgo.Block) error {
+			got = append(got, hash)
+			return nil
+		})
+		return got, err
+	}
+	expectHashes := func(t *testing.T, expected, got [][]byte) {
+		t.Helper()
+		if len(expected) != len(got) {
+			t.Fatalf("Incorrect blocks; expected '%d', got '%d'", len(expected), len(got))
+		}
+		for i, h := range expected {
+			if !bytes.Equal(h, got[i]) {
+				t.Fatalf("Incorrect block %d", i)
+			}
+		}
+	}
+	t.Run("Limit", func(t *testing.T) {
+		got, err := request(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+				BlockHash:   hashes[1],
+			},
+			Limit: 2,
+		})
+		testinggo.AssertNoError(t, err)
+		expectHashes(t, hashes[1:3], got)
+	})
+	t.Run("Until", func(t *testing.T) {
+		got, err := request(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+			Until: hashes[2],
+		})
+		testinggo.AssertNoError(t, err)
+		expectHashes(t, hashes[:2], got)
+	})
+	t.Run("Genesis", func(t *testing.T) {
+		got, err := request(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+				BlockHash:   hashes[2],
+			},
+			Limit: 10,
+		})
+		testinggo.AssertNoError(t, err)
+		expectHashes(t, hashes[2:], got)
+	})
+	t.Run("ServerLimit", func(t *testing.T) {
+		got, err := request(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+			},
+			Limit: 10,
+		})
+		if e, ok := err.(bcnetgo.ErrRangeTruncated); !ok {
+			t.Fatalf("Incorrect error; expected ErrRangeTruncated, got '%v'", err)
+		} else if !bytes.Equal(e.Next.BlockHash, hashes[4]) {
+			t.Fatalf("Incorrect next; expected '%x', got '%x'", hashes[4], e.Next.BlockHash)
+		} else {
+			expectHashes(t, hashes[:4], got)
+
+			// Resume from next
+			got, err = request(&bcnetgo.Request{
+				Reference: e.Next,
+				Limit:     6,
+			})
+			testinggo.AssertNoError(t, err)
+			expectHashes(t, hashes[4:], got)
+		}
+	})
+	t.Run("BlockNotExists", func(t *testing.T) {
+		_, err := request(&bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+				BlockHash:   []byte("FooBar123"),
+			},
+			Limit: 2,
+		})
+		expectStatus(t, bcnetgo.STATUS_NOT_FOUND, err)
+	})
+}
+
+func TestBroadcast(t *testing.T) {
+	source, hashes := makeChain(t, 3)
+	makeServer := func(t *testing.T, head []byte) *bcnetgo.Server {
+		t.Helper()
+		c := cache.NewMemory(10)
+		channel := channel.New("Test")
+		if head != nil {
+			// Server already has the chain up to head
+			testinggo.AssertNoError(t, bcgo.Iterate("Test", head, nil, source, nil, func(h []byte, b *bcgo.Block) error {
+				return c.PutBlock(h, b)
+			}))
+			block, err := source.Block(head)
+			testinggo.AssertNoError(t, err)
+			testinggo.AssertNoError(t, channel.Update(c, nil, head, block))
+		}
+		open := func(name string) (bcgo.Channel, error) {
+			if name == "Test" {
+				return channel, nil
+			}
+			return nil, errors.New("No such channel")
+		}
+		return bcnetgo.NewServer(c, nil, open)
+	}
+	broadcast := func(server *bcnetgo.Server, block *bcgo.Block) (*bcnetgo.Response, error) {
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BroadcastPortTCPHandler(s)
+		return bcnetgo.Broadcast(client, source, block)
+	}
+	expectOutcome := func(t *testing.T, expected bcnetgo.Outcome, response *bcnetgo.Response, err error) {
+		t.Helper()
+		testinggo.AssertNoError(t, err)
+		if response.Outcome != expected {
+			t.Fatalf("Incorrect outcome; expected '%s', got '%s'", expected, response.Outcome)
+		}
+	}
+	head, err := source.Block(hashes[0])
+	testinggo.AssertNoError(t, err)
+	t.Run("Accepted", func(t *testing.T) {
+		response, err := broadcast(makeServer(t, nil), head)
+		expectOutcome(t, bcnetgo.OUTCOME_ACCEPTED, response, err)
+		if !bytes.Equal(response.Reference.BlockHash, hashes[0]) {
+			t.Fatal("Incorrect head")
+		}
+	})
+	t.Run("AlreadyKnown", func(t *testing.T) {
+		response, err := broadcast(makeServer(t, hashes[0]), head)
+		expectOutcome(t, bcnetgo.OUTCOME_ALREADY_KNOWN, response, err)
+	})
+	t.Run("ShorterChain", func(t *testing.T) {
+		parent, err := source.Block(hashes[1])
+		testinggo.AssertNoError(t, err)
+		response, err := broadcast(makeServer(t, hashes[0]), parent)
+		expectOutcome(t, bcnetgo.OUTCOME_SHORTER_CHAIN, response, err)
+		if !bytes.Equal(response.Reference.BlockHash, hashes[0]) {
+			t.Fatal("Incorrect head")
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		server := makeServer(t, nil)
+		server.Open = func(name string) (bcgo.Channel, error) {
+			// Channel name does not match block
+			return channel.New("Other"), nil
+		}
+		response, err := broadcast(server, head)
+		expectOutcome(t, bcnetgo.OUTCOME_INVALID, response, err)
+		if response.Message == "" {
+			t.Fatal("Expected rejection reason")
+		}
+	})
+	t.Run("NoSuchChannel", func(t *testing.T) {
+		_, err := broadcast(makeServer(t, nil), &bcgo.Block{
+			Timestamp:   1234,
+			ChannelName: "Other",
+			Length:      1,
+		})
+		expectStatus(t, bcnetgo.STATUS_NOT_FOUND, err)
+	})
+}
+
+func TestRequestHead(t *testing.T) {
+	cache, hash, _ := makeCache(t)
+	request := func(channel string) (*bcgo.Reference, error) {
+		server, client := net.Pipe()
+		defer client.Close()
+		go bcnetgo.HeadPortTCPHandler(cache)(server)
+		return bcnetgo.RequestHead(client, channel)
+	}
+	t.Run("HeadExists", func(t *testing.T) {
+		head, err := request("Test")
+		testinggo.AssertNoError(t, err)
+		if string(hash) != string(head.BlockHash) {
+			t.Fatalf("Incorrect hash; expected '%x', got '%x'", hash, head.BlockHash)
+		}
+	})
+	t.Run("HeadNotExists", func(t *testing.T) {
+		_, err := request("Foo")
+		expectStatus(t, bcnetgo.STATUS_NOT_FOUND, err)
+	})
+}
+
+func TestRequestHeads(t *testing.T) {
+	cache, hash, _ := makeCache(t)
+	cache.PutHead("Test2", &bcgo.Reference{
+		ChannelName: "Test2",
+		BlockHash:   hash,
+	})
+	server := bcnetgo.NewServer(cache, nil, nil)
+	server.List = func() []string {
+		return []string{"Test2", "Test", "Other"}
+	}
+	request := func(channels []string, prefix string) ([]*bcnetgo.Response, error) {
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.HeadPortTCPHandler(s)
+		return bcnetgo.RequestHeads(client, channels, prefix)
+	}
+	// expectHeads fails unless the heads name the given channels with the given statuses
+	expectHeads := func(t *testing.T, heads []*bcnetgo.Response, channels []string, statuses []bcnetgo.Status) {
+		t.Helper()
+		if len(heads) != len(channels) {
+			t.Fatalf("Incorrect heads; expected '%d', got '%d'", len(channels), len(heads))
+		}
+		for i, h := range heads {
+			if h.Reference.ChannelName != channels[i] {
+				t.Fatalf("Incorrect channel; expected '%s', got '%s'", channels[i], h.Reference.ChannelName)
+			}
+			if h.Status != statuses[i] {
+				t.Fatalf("Incorrect status; expected '%s', got '%s'", statuses[i], h.Status)
+			}
+			if h.Status == bcnetgo.STATUS_OK && !bytes.Equal(hash, h.Reference.BlockHash) {
+				t.Fatalf("Incorrect hash; expected '%x', got '%x'", hash, h.Reference.BlockHash)
+			}
+		}
+	}
+	t.Run("Channels", func(t *testing.T) {
+		heads, err := request([]string{"Test", "Foo", "Test2"}, "")
+		testinggo.AssertNoError(t, err)
+		expectHeads(t, heads, []string{"Test", "Foo", "Test2"}, []bcnetgo.Status{bcnetgo.STATUS_OK, bcnetgo.STATUS_NOT_FOUND, bcnetgo.STATUS_OK})
+	})
+	t.Run("Prefix", func(t *testing.T) {
+		heads, err := request(nil, "Test")
+		testinggo.AssertNoError(t, err)
+		expectHeads(t, heads, []string{"Test", "Test2"}, []bcnetgo.Status{bcnetgo.STATUS_OK, bcnetgo.STATUS_OK})
+	})
+	t.Run("TooMany", func(t *testing.T) {
+		server.MaxHeads = 1
+		defer func() {
+			server.MaxHeads = bcnetgo.DEFAULT_MAX_HEADS
+		}()
+		_, err := request([]string{"Test", "Test2"}, "")
+		expectStatus(t, bcnetgo.STATUS_TOO_LARGE, err)
+	})
+}
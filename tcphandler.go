@@ -24,15 +24,37 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
 	"log"
 	"net"
+	"sort"
+	"strings"
 )
 
 func ConnectPortTCPHandler(network *network.TCP, allowed func(string, string) bool) func(conn net.Conn) {
-	return func(conn net.Conn) {
-		address := conn.RemoteAddr().String()
-		defer conn.Close()
-		reader := bufio.NewReader(conn)
+	s := NewServer(nil, network, nil)
+	s.Allowed = allowed
+	return s.ConnectPortTCPHandler
+}
+
+func (s *Server) ConnectPortTCPHandler(conn net.Conn) {
+	address := conn.RemoteAddr().String()
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	version, err := ReadPreamble(reader)
+	if err != nil {
+		log.Println(address, err)
+		return
+	}
+	var peer string
+	var capabilities *Capabilities
+	hello := &ClientHello{}
+	verified := false
+	if version == 0 {
+		// Legacy peers send their alias without authenticating
 		data := make([]byte, aliasgo.MAX_ALIAS_LENGTH)
 		n, err := reader.Read(data[:])
 		if err != nil {
@@ -43,190 +65,664 @@ func ConnectPortTCPHandler(network *network.TCP, allowed func(string, string) bo
 			log.Println(address, "Could not read data")
 			return
 		}
-		peer := string(data[:n])
-		if !allowed(address, peer) {
-			log.Println(address, peer, "Disallowed")
+		peer = string(data[:n])
+	} else {
+		hello, capabilities, verified, err = s.handshake(reader, writer, version, conn.LocalAddr())
+		if err != nil {
+			log.Println(address, err)
+			writeResponse(writer, version, &Response{
+				Status:  STATUS_FORBIDDEN,
+				Message: err.Error(),
+			})
 			return
 		}
-		log.Println(address, peer, "Connected")
-		if network != nil {
-			network.AddPeer(peer)
+		peer = hello.Alias
+	}
+	if !s.Allowed(address, peer) {
+		log.Println(address, peer, "Disallowed")
+		refuse(writer, version, "Disallowed")
+		return
+	}
+	if !verified && !s.allowUnverified(address, peer) {
+		log.Println(address, peer, "Unverified")
+		refuse(writer, version, "Unverified")
+		return
+	}
+	if s.Reputation != nil && s.Reputation.Banned(peer) {
+		log.Println(address, peer, "Banned")
+		refuse(writer, version, "Banned")
+		return
+	}
+	log.Println(address, peer, "Connected")
+	if verified {
+		s.setAlias(conn, peer)
+	}
+	if capabilities != nil {
+		s.setCapabilities(peer, *capabilities)
+	}
+	s.setPrivate(peer, hello.Private)
+	if s.Network != nil {
+		s.Network.AddPeer(peer)
+	}
+	s.storePeer(address, peer, verified)
+	if version > 0 {
+		if err := writeResponse(writer, version, &Response{}); err != nil {
+			log.Println(address, err)
+			return
+		}
+	}
+	if hello.WantPeers > 0 && capabilities.Has(FEATURE_PEER_EXCHANGE) {
+		if err := WriteDelimitedMessage(writer, &PeerList{
+			Peers: s.peerList(peer, hello.WantPeers),
+		}); err != nil {
+			log.Println(address, err)
+			return
 		}
 	}
 }
 
+// refuse tells a peer which sent the protocol preamble why the connect handshake failed, legacy peers are sent nothing.
+func refuse(writer *bufio.Writer, version uint64, reason string) {
+	if version > 0 {
+		writeResponse(writer, version, &Response{
+			Status:  STATUS_FORBIDDEN,
+			Message: reason,
+		})
+	}
+}
+
 func BlockPortTCPHandler(cache bcgo.Cache) func(conn net.Conn) {
-	return func(conn net.Conn) {
-		address := conn.RemoteAddr().String()
-		defer conn.Close()
-		reader := bufio.NewReader(conn)
-		writer := bufio.NewWriter(conn)
-		request := &bcgo.Reference{}
-		if err := bcgo.ReadDelimitedProtobuf(reader, request); err != nil {
+	return NewServer(cache, nil, nil).BlockPortTCPHandler
+}
+
+func (s *Server) BlockPortTCPHandler(conn net.Conn) {
+	address := conn.RemoteAddr().String()
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	version, request, err := s.readReferenceRequest(address, reader, network.PORT_GET_BLOCK)
+	if err != nil {
+		log.Println(address, err)
+		if version > 0 {
+			writeResponse(writer, version, errorResponse(err))
+		}
+		return
+	}
+	reference := request.Reference
+	blockHash := base64.RawURLEncoding.EncodeToString(reference.BlockHash)
+	if !s.canRead(conn, reference.ChannelName) {
+		log.Println(address, "Forbidden", reference.ChannelName)
+		writeResponse(writer, version, forbiddenResponse(reference.ChannelName))
+		return
+	}
+	if request.Snapshot {
+		until := base64.RawURLEncoding.EncodeToString(request.Until)
+		log.Println(address, "Snapshot Request", address, reference.ChannelName, blockHash, until, request.Limit)
+		if err := s.writeSnapshot(writer, request); err != nil {
 			log.Println(address, err)
-			return
 		}
-		blockHash := base64.RawURLEncoding.EncodeToString(request.BlockHash)
-		recordHash := base64.RawURLEncoding.EncodeToString(request.RecordHash)
-		log.Println(address, "Block Request", address, request.ChannelName, blockHash, recordHash)
-		hash := request.BlockHash
-		if hash != nil && len(hash) > 0 {
-			// Read block
-			block, err := cache.Block(hash)
-			if err != nil {
-				log.Println(address, err)
-				return
-			}
-			// Write to connection
-			log.Println(address, "Writing block")
-			if err := bcgo.WriteDelimitedProtobuf(writer, block); err != nil {
-				log.Println(address, err)
-				return
+		return
+	}
+	if request.IsRange() {
+		until := base64.RawURLEncoding.EncodeToString(request.Until)
+		log.Println(address, "Range Request", address, reference.ChannelName, blockHash, until, request.Limit)
+		if err := s.writeBlocks(writer, request); err != nil {
+			log.Println(address, err)
+		}
+		return
+	}
+	recordHash := base64.RawURLEncoding.EncodeToString(reference.RecordHash)
+	log.Println(address, "Block Request", address, reference.ChannelName, blockHash, recordHash)
+	response := s.blockResponse(reference)
+	if response.Block != nil && !s.canRead(conn, response.Block.ChannelName) {
+		response = forbiddenResponse(response.Block.ChannelName)
+	}
+	if response.Status == STATUS_OK {
+		log.Println(address, "Writing block")
+	} else {
+		log.Println(address, response.Status, response.Message)
+	}
+	// Write to connection
+	if err := writeResponse(writer, version, response); err != nil {
+		log.Println(address, err)
+		return
+	}
+}
+
+func (s *Server) blockResponse(request *bcgo.Reference) *Response {
+	hash := request.BlockHash
+	if hash != nil && len(hash) > 0 {
+		// Read block
+		block, err := s.Cache.Block(hash)
+		if err != nil {
+			return &Response{
+				Status:  STATUS_NOT_FOUND,
+				Message: err.Error(),
 			}
-		} else {
-			reference, err := cache.Head(request.ChannelName)
-			if err != nil {
-				log.Println(address, err)
-				return
+		}
+		return &Response{
+			Block: block,
+		}
+	}
+	hash = request.RecordHash
+	if hash == nil || len(hash) == 0 {
+		return &Response{
+			Status:  STATUS_BAD_REQUEST,
+			Message: "Missing block hash and record hash",
+		}
+	}
+	if index := s.recordIndex(); index != nil {
+		return s.indexedBlockResponse(index, request.ChannelName, hash)
+	}
+	reference, err := s.Cache.Head(request.ChannelName)
+	if err != nil {
+		return &Response{
+			Status:  STATUS_NOT_FOUND,
+			Message: err.Error(),
+		}
+	}
+	// Search through chain until record hash is found, and return the containing block
+	var block *bcgo.Block
+	if err := bcgo.Iterate(request.ChannelName, reference.BlockHash, nil, s.Cache, nil, func(h []byte, b *bcgo.Block) error {
+		for _, e := range b.Entry {
+			if bytes.Equal(e.RecordHash, hash) {
+				block = b
+				return bcgo.ErrStopIteration{}
 			}
-			hash := request.RecordHash
-			if hash != nil && len(hash) > 0 {
-				// Search through chain until record hash is found, and return the containing block
-				if err := bcgo.Iterate(request.ChannelName, reference.BlockHash, nil, cache, nil, func(h []byte, b *bcgo.Block) error {
-					for _, e := range b.Entry {
-						if bytes.Equal(e.RecordHash, hash) {
-							log.Println(address, "Found record, writing block")
-							// Write to connection
-							if err := bcgo.WriteDelimitedProtobuf(writer, b); err != nil {
-								return err
-							}
-							return bcgo.ErrStopIteration{}
-						}
-					}
-					return nil
-				}); err != nil {
-					switch err.(type) {
-					case bcgo.ErrStopIteration:
-						// Do nothing
-						break
-					default:
-						log.Println(address, err)
-						return
-					}
-				}
-			} else {
-				log.Println(address, "Missing block hash and record hash")
-				return
+		}
+		return nil
+	}); err != nil {
+		switch err.(type) {
+		case bcgo.ErrStopIteration:
+			// Do nothing
+			break
+		default:
+			return &Response{
+				Status:  STATUS_INTERNAL_ERROR,
+				Message: err.Error(),
 			}
 		}
 	}
+	if block == nil {
+		return &Response{
+			Status:  STATUS_NOT_FOUND,
+			Message: "Record not found",
+		}
+	}
+	return &Response{
+		Block: block,
+	}
 }
 
-func HeadPortTCPHandler(cache bcgo.Cache) func(conn net.Conn) {
-	return func(conn net.Conn) {
-		address := conn.RemoteAddr().String()
-		defer conn.Close()
-		reader := bufio.NewReader(conn)
-		writer := bufio.NewWriter(conn)
-		request := &bcgo.Reference{}
-		if err := bcgo.ReadDelimitedProtobuf(reader, request); err != nil {
-			log.Println(address, err)
-			return
+// writeBlocks streams the requested range of blocks, ending with a Response marking the end of the stream,
+// which references the next block if the range was truncated by MaxRangeBlocks.
+func (s *Server) writeBlocks(writer *bufio.Writer, request *Request) error {
+	next, response := s.walkBlocks(request, s.MaxRangeBlocks, func(hash []byte, block *bcgo.Block) error {
+		return WriteDelimitedMessage(writer, &Response{
+			Block: block,
+			Reference: &bcgo.Reference{
+				Timestamp:   block.Timestamp,
+				ChannelName: block.ChannelName,
+				BlockHash:   hash,
+			},
+		})
+	})
+	if response != nil {
+		return WriteDelimitedMessage(writer, response)
+	}
+	end := &Response{
+		End: true,
+	}
+	if len(next) > 0 {
+		end.Reference = &bcgo.Reference{
+			ChannelName: request.Reference.ChannelName,
+			BlockHash:   next,
 		}
-		log.Println(address, "Head Request", address, request.ChannelName)
-		reference, err := cache.Head(request.ChannelName)
+	}
+	return WriteDelimitedMessage(writer, end)
+}
+
+// walkBlocks calls callback with each block in the requested range, newest first, up to the smaller of max and the requested limit.
+// It returns the hash of the next block if the walk was stopped by max before the requested range ended,
+// or a final Response if a block could not be found, or an error if callback fails.
+func (s *Server) walkBlocks(request *Request, max uint64, callback func([]byte, *bcgo.Block) error) ([]byte, *Response) {
+	limit := max
+	if request.Limit > 0 && (limit == 0 || request.Limit < limit) {
+		limit = request.Limit
+	}
+	channel := request.Reference.ChannelName
+	hash := request.Reference.BlockHash
+	if len(hash) == 0 {
+		reference, err := s.Cache.Head(channel)
 		if err != nil {
-			log.Println(address, err)
-			return
+			return nil, &Response{
+				Status:  STATUS_NOT_FOUND,
+				Message: err.Error(),
+				End:     true,
+			}
 		}
-		blockHash := base64.RawURLEncoding.EncodeToString(reference.BlockHash)
-		log.Println(address, "Head Response", reference.ChannelName, blockHash)
-		if err := bcgo.WriteDelimitedProtobuf(writer, reference); err != nil {
-			log.Println(address, err)
-			return
+		hash = reference.BlockHash
+	}
+	for count := uint64(0); len(hash) > 0 && !bytes.Equal(hash, request.Until) && (limit == 0 || count < limit); count++ {
+		block, err := s.Cache.Block(hash)
+		if err != nil {
+			return nil, &Response{
+				Status:  STATUS_NOT_FOUND,
+				Message: err.Error(),
+				End:     true,
+			}
+		}
+		if block.ChannelName != channel {
+			return nil, &Response{
+				Status:  STATUS_BAD_REQUEST,
+				Message: "Block not in channel",
+				End:     true,
+			}
 		}
+		if err := callback(hash, block); err != nil {
+			return nil, &Response{
+				Status:  STATUS_INTERNAL_ERROR,
+				Message: err.Error(),
+				End:     true,
+			}
+		}
+		hash = block.Previous
+	}
+	if len(hash) > 0 && !bytes.Equal(hash, request.Until) && (request.Limit == 0 || request.Limit > limit) {
+		// Stopped by the server's maximum rather than the request
+		return hash, nil
 	}
+	return nil, nil
 }
 
-func BroadcastPortTCPHandler(cache bcgo.Cache, network *network.TCP, open func(string) (bcgo.Channel, error)) func(conn net.Conn) {
-	return func(conn net.Conn) {
-		address := conn.RemoteAddr().String()
-		defer conn.Close()
-		reader := bufio.NewReader(conn)
-		writer := bufio.NewWriter(conn)
-		block := &bcgo.Block{}
-		if err := bcgo.ReadDelimitedProtobuf(reader, block); err != nil {
-			log.Println(address, err)
-			return
+func (s *Server) indexedBlockResponse(index RecordIndex, channel string, record []byte) *Response {
+	hash, err := index.BlockHash(channel, record)
+	if err != nil {
+		status := STATUS_INTERNAL_ERROR
+		if _, ok := err.(ErrRecordNotIndexed); ok {
+			status = STATUS_NOT_FOUND
 		}
-		hash, err := cryptogo.HashProtobuf(block)
-		if err != nil {
-			log.Println(address, err)
-			return
+		return &Response{
+			Status:  status,
+			Message: err.Error(),
 		}
-		blockHash := base64.RawURLEncoding.EncodeToString(hash)
-		log.Println(address, "Broadcast", address, block.ChannelName, blockHash)
-		channel, err := open(block.ChannelName)
-		if err != nil {
+	}
+	block, err := s.Cache.Block(hash)
+	if err != nil {
+		return &Response{
+			Status:  STATUS_NOT_FOUND,
+			Message: err.Error(),
+		}
+	}
+	return &Response{
+		Block: block,
+	}
+}
+
+func HeadPortTCPHandler(cache bcgo.Cache) func(conn net.Conn) {
+	return NewServer(cache, nil, nil).HeadPortTCPHandler
+}
+
+func (s *Server) HeadPortTCPHandler(conn net.Conn) {
+	address := conn.RemoteAddr().String()
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	version, request, err := s.readReferenceRequest(address, reader, network.PORT_GET_HEAD)
+	if err != nil {
+		log.Println(address, err)
+		if version > 0 {
+			writeResponse(writer, version, errorResponse(err))
+		}
+		return
+	}
+	if request.Subscribe {
+		s.subscribe(address, conn, writer, version, request)
+		return
+	}
+	if request.IsMultiple() {
+		response := s.headsResponse(conn, request)
+		log.Println(address, "Heads Response", len(response.Heads), response.Status, response.Message)
+		if err := writeResponse(writer, version, response); err != nil {
 			log.Println(address, err)
-			return
 		}
+		return
+	}
+	log.Println(address, "Head Request", address, request.Reference.ChannelName)
+	var response *Response
+	if s.canRead(conn, request.Reference.ChannelName) {
+		response = s.headResponse(request.Reference)
+	} else {
+		response = forbiddenResponse(request.Reference.ChannelName)
+	}
+	if response.Status == STATUS_OK {
+		blockHash := base64.RawURLEncoding.EncodeToString(response.Reference.BlockHash)
+		log.Println(address, "Head Response", response.Reference.ChannelName, blockHash)
+	} else {
+		log.Println(address, response.Status, response.Message)
+	}
+	if err := writeResponse(writer, version, response); err != nil {
+		log.Println(address, err)
+		return
+	}
+}
 
-		b := block
-		for b != nil {
-			h := b.Previous
-			if h != nil && len(h) > 0 {
-				b, err = cache.Block(h)
-				if err != nil {
-					// Request block from broadcaster
-					if err := bcgo.WriteDelimitedProtobuf(writer, &bcgo.Reference{
-						ChannelName: channel.Name(),
-						BlockHash:   h,
-					}); err != nil {
-						log.Println(address, err)
-						return
-					}
-					b = &bcgo.Block{}
-					if err := bcgo.ReadDelimitedProtobuf(reader, b); err != nil {
-						log.Println(address, err)
-						return
-					}
-					bh, err := cryptogo.HashProtobuf(b)
-					if err != nil {
-						log.Println(address, err)
-						return
-					}
-					if !bytes.Equal(h, bh) {
-						log.Println(address, "Got wrong block from broadcaster")
-						return
-					}
-					cache.PutBlock(h, b)
-				} else {
-					break
-				}
-			} else {
-				b = nil
+func (s *Server) headResponse(request *bcgo.Reference) *Response {
+	reference, err := s.Cache.Head(request.ChannelName)
+	if err != nil {
+		return &Response{
+			Status:  STATUS_NOT_FOUND,
+			Message: err.Error(),
+		}
+	}
+	return &Response{
+		Reference: reference,
+	}
+}
+
+// headsResponse returns the heads of the requested channels, and those matching the requested prefix,
+// with the status of each so an unknown or forbidden channel does not fail the whole request.
+func (s *Server) headsResponse(conn net.Conn, request *Request) *Response {
+	channels := request.ChannelNames()
+	if request.Prefix != "" {
+		if s.List == nil {
+			return &Response{
+				Status:  STATUS_BAD_REQUEST,
+				Message: "Prefix not supported",
+			}
+		}
+		seen := make(map[string]bool)
+		for _, c := range channels {
+			seen[c] = true
+		}
+		names := s.List()
+		sort.Strings(names)
+		for _, c := range names {
+			// Channels matched by prefix are only returned if readable, so their existence is not revealed
+			if strings.HasPrefix(c, request.Prefix) && !seen[c] && s.canRead(conn, c) {
+				channels = append(channels, c)
+				seen[c] = true
 			}
 		}
+	}
+	if s.MaxHeads > 0 && len(channels) > s.MaxHeads {
+		return &Response{
+			Status:  STATUS_TOO_LARGE,
+			Message: "Too many channels",
+		}
+	}
+	response := &Response{}
+	for _, c := range channels {
+		var head *Response
+		if s.canRead(conn, c) {
+			head = s.headResponse(&bcgo.Reference{
+				ChannelName: c,
+			})
+		} else {
+			head = forbiddenResponse(c)
+		}
+		if head.Reference == nil {
+			// Name the channel so the client knows which failed
+			head.Reference = &bcgo.Reference{
+				ChannelName: c,
+			}
+		}
+		response.Heads = append(response.Heads, head)
+	}
+	return response
+}
 
-		if err := channel.Update(cache, network, hash, block); err != nil {
-			log.Println(address, err)
-			// return - Must send head reference back
-		} else if network != nil {
-			if peer := network.PeerForAddress(address); peer != "" {
-				// Peer sucessfully updated a channel so reset error count
-				network.AddPeer(peer)
+func BroadcastPortTCPHandler(cache bcgo.Cache, network *network.TCP, open func(string) (bcgo.Channel, error)) func(conn net.Conn) {
+	return NewServer(cache, network, open).BroadcastPortTCPHandler
+}
+
+func (s *Server) BroadcastPortTCPHandler(conn net.Conn) {
+	address := conn.RemoteAddr().String()
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	version, err := ReadPreamble(reader)
+	if err != nil {
+		log.Println(address, err)
+		return
+	}
+	if version > 0 && !s.supportsVersion(version) {
+		err := fmt.Errorf("Unsupported protocol version: %d", version)
+		log.Println(address, err)
+		writeResponse(writer, version, errorResponse(err))
+		return
+	}
+	block := &bcgo.Block{}
+	if err := s.readProtobuf(address, reader, block, network.PORT_BROADCAST); err != nil {
+		log.Println(address, err)
+		writeResponse(writer, version, errorResponse(err))
+		return
+	}
+	hash, err := cryptogo.HashProtobuf(block)
+	if err != nil {
+		log.Println(address, err)
+		return
+	}
+	blockHash := base64.RawURLEncoding.EncodeToString(hash)
+	log.Println(address, "Broadcast", address, block.ChannelName, blockHash)
+	if !s.canWrite(conn, block.ChannelName) {
+		log.Println(address, "Forbidden", block.ChannelName)
+		writeResponse(writer, version, forbiddenResponse(block.ChannelName))
+		return
+	}
+	channel, err := s.Open(block.ChannelName)
+	if err != nil {
+		log.Println(address, err)
+		writeResponse(writer, version, &Response{
+			Status:  STATUS_NOT_FOUND,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	// Concurrent broadcasts of the same block share one back-fill and update
+	response, leader, err := s.coalesce(channel.Name(), hash, func() (*Response, error) {
+		// Stage back-filled blocks until the channel accepts the chain
+		staging := newStagingCache(s.Cache)
+		if err := s.backfill(address, reader, writer, version, staging, channel.Name(), block); err != nil {
+			return nil, err
+		}
+		return s.update(address, staging, channel, hash, block), nil
+	})
+	if err != nil {
+		log.Println(address, err)
+		writeResponse(writer, version, errorResponse(err))
+		return
+	}
+	switch response.Outcome {
+	case OUTCOME_ACCEPTED, OUTCOME_ALREADY_KNOWN:
+		if response.Outcome == OUTCOME_ACCEPTED {
+			// Peer sucessfully updated a channel so reset error count, repeating a known block earns nothing
+			s.peerEvent(address, EVENT_SUCCESS)
+		}
+		if s.Network != nil {
+			if peer := s.Network.PeerForAddress(address); peer != "" {
+				s.Network.AddPeer(peer)
 			}
 		}
+	case OUTCOME_INVALID, OUTCOME_VALIDATION_FAILED:
+		s.peerEvent(address, EVENT_REJECTED_BLOCK)
+	}
+
+	if version == 0 && response.Outcome == OUTCOME_SHORTER_CHAIN {
+		// Legacy peers receive the longer head so they can fetch it, other failures close the connection
+		response.Status = STATUS_OK
+	}
+	if err := writeResponse(writer, version, response); err != nil {
+		log.Println(address, err)
+		return
+	}
+
+	if leader && response.Outcome == OUTCOME_ACCEPTED {
+		s.enqueueRelay(address, hash, block)
+	}
+}
 
+// update validates the broadcast block and passes it to the channel, whose new head writes the staged chain to the cache,
+// and returns a response holding the resulting head.
+func (s *Server) update(address string, staging *stagingCache, channel bcgo.Channel, hash []byte, block *bcgo.Block) (response *Response) {
+	lock := s.channelLock(channel.Name())
+	lock.Lock()
+	defer lock.Unlock()
+	defer func() {
 		// Reply with current head
-		if err := bcgo.WriteDelimitedProtobuf(writer, &bcgo.Reference{
+		response.Reference = &bcgo.Reference{
 			Timestamp:   channel.Timestamp(),
 			ChannelName: channel.Name(),
 			BlockHash:   channel.Head(),
-		}); err != nil {
-			log.Println(address, err)
-			return
 		}
+		if response.Outcome == OUTCOME_ACCEPTED {
+			s.publishHead(response.Reference)
+		}
+	}()
+	if bytes.Equal(channel.Head(), hash) {
+		return &Response{
+			Outcome: OUTCOME_ALREADY_KNOWN,
+		}
+	}
+	if err := s.validate(channel.Name(), hash, block, staging.staged()); err != nil {
+		log.Println(address, err)
+		return &Response{
+			Status:  STATUS_BAD_REQUEST,
+			Message: err.Error(),
+			Outcome: OUTCOME_VALIDATION_FAILED,
+		}
+	}
+	timestamp, head := channel.Timestamp(), channel.Head()
+	if err := channel.Update(staging, s.Network, hash, block); err != nil {
+		log.Println(address, err)
+		if _, ok := err.(ErrStagingFlush); ok {
+			// Undo the head the channel moved before the staged blocks could be written
+			channel.Set(timestamp, head)
+			return &Response{
+				Status:  STATUS_INTERNAL_ERROR,
+				Message: err.Error(),
+			}
+		}
+		outcome := OUTCOME_INVALID
+		if head, err := staging.Block(channel.Head()); err == nil && head.Length >= block.Length {
+			outcome = OUTCOME_SHORTER_CHAIN
+		}
+		return &Response{
+			Status:  STATUS_BAD_REQUEST,
+			Message: err.Error(),
+			Outcome: outcome,
+		}
+	}
+	return &Response{
+		Outcome: OUTCOME_ACCEPTED,
+	}
+}
+
+// readReferenceRequest reads a request from either a legacy peer or one which sends the protocol preamble,
+// and returns the requested protocol version.
+func (s *Server) readReferenceRequest(address string, reader *bufio.Reader, port int) (uint64, *Request, error) {
+	version, err := ReadPreamble(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	request := &Request{}
+	switch version {
+	case 0:
+		request.Reference = &bcgo.Reference{}
+		err = s.readProtobuf(address, reader, request.Reference, port)
+	default:
+		if !s.supportsVersion(version) {
+			return version, nil, fmt.Errorf("Unsupported protocol version: %d", version)
+		}
+		err = s.readMessage(address, reader, request, port)
+		if err == nil && request.Reference == nil && !(port == network.PORT_GET_HEAD && (request.Subscribe || request.IsMultiple())) {
+			err = errors.New("Missing reference")
+		}
+	}
+	return version, request, err
+}
+
+func (s *Server) readProtobuf(address string, reader *bufio.Reader, message proto.Message, port int) error {
+	data, err := s.readRequest(address, reader, port)
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(data, message); err != nil {
+		s.peerEvent(address, EVENT_MALFORMED)
+		return err
+	}
+	return nil
+}
+
+func (s *Server) readMessage(address string, reader *bufio.Reader, message Message, port int) error {
+	data, err := s.readRequest(address, reader, port)
+	if err != nil {
+		return err
+	}
+	if err := message.Unmarshal(data); err != nil {
+		s.peerEvent(address, EVENT_MALFORMED)
+		return err
+	}
+	return nil
+}
+
+// readRequest reads a request from the peer, counting an error against it if the request is larger than the port allows.
+func (s *Server) readRequest(address string, reader *bufio.Reader, port int) ([]byte, error) {
+	limit, ok := s.MaxRequestSize[port]
+	if !ok {
+		switch port {
+		case network.PORT_BROADCAST:
+			limit = DEFAULT_MAX_BLOCK_SIZE
+		case network.PORT_GET_HEAD:
+			// Large enough to name many channels
+			limit = DEFAULT_MAX_HEAD_REQUEST_SIZE
+		default:
+			limit = DEFAULT_MAX_REFERENCE_SIZE
+		}
+	}
+	data, err := readDelimited(reader, limit)
+	if _, ok := err.(ErrMessageTooLarge); ok {
+		s.peerEvent(address, EVENT_TOO_LARGE)
+	}
+	return data, err
+}
+
+// writeResponse writes the response in the form expected by the peer's protocol version.
+func writeResponse(writer *bufio.Writer, version uint64, response *Response) error {
+	if version > 0 {
+		return WriteDelimitedMessage(writer, response)
+	}
+	switch {
+	case response.Status != STATUS_OK:
+		// Legacy peers only observe the connection closing
+		return nil
+	case response.Block != nil:
+		return bcgo.WriteDelimitedProtobuf(writer, response.Block)
+	case response.Reference != nil:
+		return bcgo.WriteDelimitedProtobuf(writer, response.Reference)
+	}
+	return nil
+}
+
+// writeMissing asks the broadcaster for a block missing from the chain being broadcast.
+func writeMissing(writer *bufio.Writer, version uint64, reference *bcgo.Reference) error {
+	if version > 0 {
+		return WriteDelimitedMessage(writer, &Response{
+			Missing: reference,
+		})
+	}
+	return bcgo.WriteDelimitedProtobuf(writer, reference)
+}
+
+func errorResponse(err error) *Response {
+	status := STATUS_BAD_REQUEST
+	switch err.(type) {
+	case ErrMessageTooLarge, ErrBackfillExceeded:
+		status = STATUS_TOO_LARGE
+	}
+	return &Response{
+		Status:  status,
+		Message: err.Error(),
 	}
 }
@@ -23,6 +23,7 @@ import (
 	"aletheiaware.com/bcgo/network"
 	"aletheiaware.com/bcnetgo"
 	"aletheiaware.com/cryptogo"
+	"aletheiaware.com/testinggo"
 	"bufio"
 	"encoding/base64"
 	"errors"
@@ -188,6 +189,40 @@ func TestBlockPortTCPHandler(t *testing.T) {
 			t.Fatal("Expected error")
 		}
 	})
+	t.Run("RequestTooLarge", func(t *testing.T) {
+		server := bcnetgo.NewServer(cache.NewMemory(10), nil, nil)
+		server.MaxRequestSize = map[int]uint64{
+			network.PORT_GET_BLOCK: 8,
+		}
+		s, client := net.Pipe()
+		defer client.Close()
+
+		// Start server in goroutine
+		done := make(chan struct{})
+		go func() {
+			server.BlockPortTCPHandler(s)
+			close(done)
+		}()
+
+		// Write block request to client conn
+		writer := bufio.NewWriter(client)
+		go bcgo.WriteDelimitedProtobuf(writer, &bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   []byte("FooBar123"),
+		})
+
+		// Read block from client conn
+		reader := bufio.NewReader(client)
+		block := &bcgo.Block{}
+		if err := bcgo.ReadDelimitedProtobuf(reader, block); err == nil {
+			t.Fatal("Expected error")
+		}
+		<-done
+
+		if got := server.PeerErrors("pipe"); got != 1 {
+			t.Fatalf("Incorrect peer errors; expected '%d', got '%d'", 1, got)
+		}
+	})
 	t.Run("RecordExists", func(t *testing.T) {
 		// TODO
 	})
@@ -268,6 +303,15 @@ func TestHeadPortTCPHandler(t *testing.T) {
 	})
 }
 
+// failingCache is a cache which cannot write blocks.
+type failingCache struct {
+	bcgo.Cache
+}
+
+func (c *failingCache) PutBlock(hash []byte, block *bcgo.Block) error {
+	return errors.New("Disk full")
+}
+
 func TestBroadcastPortTCPHandler(t *testing.T) {
 	t.Run("NoSuchChannel", func(t *testing.T) {
 		open := func(name string) (bcgo.Channel, error) {
@@ -299,6 +343,48 @@ func TestBroadcastPortTCPHandler(t *testing.T) {
 			t.Fatal("Expected error")
 		}
 	})
+	t.Run("BlockTooLarge", func(t *testing.T) {
+		channel := channel.New("Test")
+		open := func(name string) (bcgo.Channel, error) {
+			return channel, nil
+		}
+		server := bcnetgo.NewServer(cache.NewMemory(10), makeNetwork(t), open)
+		server.MaxRequestSize = map[int]uint64{
+			network.PORT_BROADCAST: 8,
+		}
+		s, client := net.Pipe()
+		defer client.Close()
+
+		// Start server in goroutine
+		done := make(chan struct{})
+		go func() {
+			server.BroadcastPortTCPHandler(s)
+			close(done)
+		}()
+
+		// Write broadcast request to client conn
+		writer := bufio.NewWriter(client)
+		go bcgo.WriteDelimitedProtobuf(writer, &bcgo.Block{
+			Timestamp:   1234,
+			ChannelName: "Test",
+			Length:      1,
+		})
+
+		// Read head from client conn
+		reader := bufio.NewReader(client)
+		head := &bcgo.Reference{}
+		if err := bcgo.ReadDelimitedProtobuf(reader, head); err == nil {
+			t.Fatal("Expected error")
+		}
+		<-done
+
+		if channel.Head() != nil {
+			t.Fatal("Expected channel to not be updated")
+		}
+		if got := server.PeerErrors("pipe"); got != 1 {
+			t.Fatalf("Incorrect peer errors; expected '%d', got '%d'", 1, got)
+		}
+	})
 	t.Run("ClientLongerThanServer", func(t *testing.T) {
 		clientBlock := &bcgo.Block{
 			Timestamp:   1234,
@@ -417,6 +503,85 @@ func TestBroadcastPortTCPHandler(t *testing.T) {
 		if expected != got {
 			t.Fatalf("Incorrect hash; expected '%s', got '%s'", expected, got)
 		}
+
+		// Expect back-filled block to be persisted
+		if _, err := cache.Block(clientHash1); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("BackfillLimit", func(t *testing.T) {
+		clientCache, hashes := makeChain(t, 3)
+		head, err := clientCache.Block(hashes[0])
+		testinggo.AssertNoError(t, err)
+		parent, err := clientCache.Block(hashes[1])
+		testinggo.AssertNoError(t, err)
+		cache := cache.NewMemory(10)
+		channel := channel.New("Test")
+		open := func(name string) (bcgo.Channel, error) {
+			return channel, nil
+		}
+		server := bcnetgo.NewServer(cache, makeNetwork(t), open)
+		server.MaxBackfillBlocks = 1
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BroadcastPortTCPHandler(s)
+		reader := bufio.NewReader(client)
+		writer := bufio.NewWriter(client)
+		testinggo.AssertNoError(t, bcnetgo.WritePreamble(writer, bcnetgo.PROTOCOL_VERSION))
+		testinggo.AssertNoError(t, bcgo.WriteDelimitedProtobuf(writer, head))
+
+		// Supply first missing block
+		response := &bcnetgo.Response{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(reader, response, bcnetgo.DEFAULT_MAX_BLOCK_SIZE))
+		if response.Missing == nil {
+			t.Fatal("Expected missing block request")
+		}
+		testinggo.AssertNoError(t, bcgo.WriteDelimitedProtobuf(writer, parent))
+
+		// Expect server to give up instead of asking for the second
+		response = &bcnetgo.Response{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(reader, response, bcnetgo.DEFAULT_MAX_BLOCK_SIZE))
+		if response.Status != bcnetgo.STATUS_TOO_LARGE {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_TOO_LARGE, response.Status)
+		}
+		if _, err := cache.Block(hashes[1]); err == nil {
+			t.Fatal("Expected back-filled block to not be persisted")
+		}
+		if channel.Head() != nil {
+			t.Fatal("Expected channel to not be updated")
+		}
+	})
+	t.Run("CacheFailure", func(t *testing.T) {
+		cache := &failingCache{cache.NewMemory(10)}
+		channel := channel.New("Test")
+		open := func(name string) (bcgo.Channel, error) {
+			return channel, nil
+		}
+		server := bcnetgo.NewServer(cache, makeNetwork(t), open)
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BroadcastPortTCPHandler(s)
+		reader := bufio.NewReader(client)
+		writer := bufio.NewWriter(client)
+		testinggo.AssertNoError(t, bcnetgo.WritePreamble(writer, bcnetgo.PROTOCOL_VERSION))
+		testinggo.AssertNoError(t, bcgo.WriteDelimitedProtobuf(writer, &bcgo.Block{
+			Timestamp:   1234,
+			ChannelName: "Test",
+			Length:      1,
+		}))
+
+		// Expect the head to not move when its block cannot be written
+		response := &bcnetgo.Response{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(reader, response, bcnetgo.DEFAULT_MAX_BLOCK_SIZE))
+		if response.Status != bcnetgo.STATUS_INTERNAL_ERROR {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_INTERNAL_ERROR, response.Status)
+		}
+		if channel.Head() != nil {
+			t.Fatal("Expected channel to not be updated")
+		}
+		if _, err := cache.Head("Test"); err == nil {
+			t.Fatal("Expected head to not be written")
+		}
 	})
 	t.Run("ServerClientEqualLength", func(t *testing.T) {
 		serverBlock := &bcgo.Block{
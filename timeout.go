@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	DEFAULT_HANDSHAKE_TIMEOUT = 10 * time.Second
+	DEFAULT_READ_TIMEOUT      = 30 * time.Second
+	DEFAULT_WRITE_TIMEOUT     = 30 * time.Second
+	DEFAULT_SESSION_TIMEOUT   = 5 * time.Minute
+)
+
+// timeoutConn sets a deadline before every read and write, bounded by the deadline of the whole session.
+type timeoutConn struct {
+	net.Conn
+	server   *Server
+	session  time.Time
+	started  bool
+	timedout bool
+}
+
+func (s *Server) withTimeouts(conn net.Conn) net.Conn {
+	c := &timeoutConn{
+		Conn:   conn,
+		server: s,
+	}
+	if s.SessionTimeout > 0 {
+		c.session = time.Now().Add(s.SessionTimeout)
+	}
+	return c
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.started {
+		c.Conn.SetReadDeadline(c.deadline(c.server.ReadTimeout))
+	} else {
+		// Also bound writes made during the handshake, such as by TLS
+		c.Conn.SetDeadline(c.deadline(c.server.HandshakeTimeout))
+		c.started = true
+	}
+	n, err := c.Conn.Read(b)
+	c.check(err)
+	return n, err
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(c.deadline(c.server.WriteTimeout))
+	n, err := c.Conn.Write(b)
+	c.check(err)
+	return n, err
+}
+
+func (c *timeoutConn) deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return c.session
+	}
+	deadline := time.Now().Add(timeout)
+	if !c.session.IsZero() && c.session.Before(deadline) {
+		return c.session
+	}
+	return deadline
+}
+
+func (c *timeoutConn) check(err error) {
+	if e, ok := err.(net.Error); ok && e.Timeout() && !c.timedout {
+		c.timedout = true
+		log.Println(c.RemoteAddr(), "Timed out")
+		c.server.count(func(m *Metrics) {
+			m.Timeouts++
+		})
+		c.server.peerEvent(c.RemoteAddr().String(), EVENT_TIMEOUT)
+	}
+}
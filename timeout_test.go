@@ -0,0 +1,62 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	// expectTimeout connects to the broadcast port without sending anything and waits for the server to hang up
+	expectTimeout := func(t *testing.T, server *bcnetgo.Server) {
+		t.Helper()
+		testinggo.AssertNoError(t, server.Start())
+		defer server.Shutdown(context.Background())
+
+		client, err := net.Dial("tcp", server.Addr(network.PORT_BROADCAST).String())
+		testinggo.AssertNoError(t, err)
+		defer client.Close()
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Expected error")
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			t.Fatal("Expected server to close connection")
+		}
+
+		if got := server.Metrics().Timeouts; got != 1 {
+			t.Fatalf("Incorrect timeouts; expected '%d', got '%d'", 1, got)
+		}
+	}
+	t.Run("Handshake", func(t *testing.T) {
+		server := makeServer(t)
+		server.HandshakeTimeout = 100 * time.Millisecond
+		expectTimeout(t, server)
+	})
+	t.Run("Session", func(t *testing.T) {
+		server := makeServer(t)
+		server.HandshakeTimeout = 0
+		server.SessionTimeout = 100 * time.Millisecond
+		expectTimeout(t, server)
+	})
+}
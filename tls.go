@@ -0,0 +1,69 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// NewTLSConfig returns a TLS configuration which presents the given certificate.
+// If clientCAs is not nil, peers must present a certificate issued by one of its authorities.
+func NewTLSConfig(certificate tls.Certificate, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = clientCAs
+	}
+	return config
+}
+
+// ClientTLSConfig returns a configuration for dialing peers whose ports are secured like the given server configuration,
+// presenting its certificates, and trusting the authorities it accepts client certificates from, or the system roots if none.
+func ClientTLSConfig(config *tls.Config) *tls.Config {
+	return &tls.Config{
+		Certificates: config.Certificates,
+		RootCAs:      config.ClientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// LoadTLSConfig returns a TLS configuration from the given PEM encoded certificate and key files.
+// If clientCAFile is not empty, peers must present a certificate issued by one of the authorities it contains.
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var clientCAs *x509.CertPool
+	if clientCAFile != "" {
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("No certificates found in " + clientCAFile)
+		}
+	}
+	return NewTLSConfig(certificate, clientCAs), nil
+}
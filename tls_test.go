@@ -0,0 +1,208 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func makeCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testinggo.AssertNoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		// Self-signed certificate authority
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	testinggo.AssertNoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	testinggo.AssertNoError(t, err)
+	return certificate, key, tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca, caKey, _ := makeCertificate(t, "CA", nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	_, _, serverCertificate := makeCertificate(t, "Server", ca, caKey)
+	_, _, clientCertificate := makeCertificate(t, "Client", ca, caKey)
+
+	makeTLSServer := func(t *testing.T) *bcnetgo.Server {
+		t.Helper()
+		server := makeServer(t)
+		server.TLSConfig = bcnetgo.NewTLSConfig(serverCertificate, pool)
+		server.Cache.PutHead("Test", &bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   []byte("FooBar123"),
+		})
+		testinggo.AssertNoError(t, server.Start())
+		return server
+	}
+	requestHead := func(conn net.Conn) (*bcgo.Reference, error) {
+		reader := bufio.NewReader(conn)
+		writer := bufio.NewWriter(conn)
+		if err := bcgo.WriteDelimitedProtobuf(writer, &bcgo.Reference{
+			ChannelName: "Test",
+		}); err != nil {
+			return nil, err
+		}
+		head := &bcgo.Reference{}
+		if err := bcgo.ReadDelimitedProtobuf(reader, head); err != nil {
+			return nil, err
+		}
+		return head, nil
+	}
+
+	t.Run("ClientCertificate", func(t *testing.T) {
+		server := makeTLSServer(t)
+		defer server.Shutdown(context.Background())
+
+		client, err := tls.Dial("tcp", server.Addr(network.PORT_GET_HEAD).String(), &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{clientCertificate},
+		})
+		testinggo.AssertNoError(t, err)
+		defer client.Close()
+
+		head, err := requestHead(client)
+		testinggo.AssertNoError(t, err)
+		if string(head.BlockHash) != "FooBar123" {
+			t.Fatalf("Incorrect hash; expected '%s', got '%s'", "FooBar123", string(head.BlockHash))
+		}
+	})
+	t.Run("NoClientCertificate", func(t *testing.T) {
+		server := makeTLSServer(t)
+		defer server.Shutdown(context.Background())
+
+		client, err := tls.Dial("tcp", server.Addr(network.PORT_GET_HEAD).String(), &tls.Config{
+			RootCAs: pool,
+		})
+		if err != nil {
+			// Handshake rejected
+			return
+		}
+		defer client.Close()
+
+		if _, err := requestHead(client); err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+	t.Run("ClientTLSConfig", func(t *testing.T) {
+		server := makeTLSServer(t)
+		defer server.Shutdown(context.Background())
+
+		// Peers sharing an authority dial each other with their own certificate
+		client, err := tls.Dial("tcp", server.Addr(network.PORT_GET_HEAD).String(), bcnetgo.ClientTLSConfig(bcnetgo.NewTLSConfig(clientCertificate, pool)))
+		testinggo.AssertNoError(t, err)
+		defer client.Close()
+
+		head, err := requestHead(client)
+		testinggo.AssertNoError(t, err)
+		if string(head.BlockHash) != "FooBar123" {
+			t.Fatalf("Incorrect hash; expected '%s', got '%s'", "FooBar123", string(head.BlockHash))
+		}
+	})
+	t.Run("VerifiedAliasBoundToCertificate", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		testinggo.AssertNoError(t, err)
+		_, _, otherCertificate := makeCertificate(t, "Other", ca, caKey)
+		server := makeServer(t)
+		server.TLSConfig = bcnetgo.NewTLSConfig(serverCertificate, pool)
+		server.Cache.PutHead("Test", &bcgo.Reference{
+			ChannelName: "Test",
+			BlockHash:   []byte("FooBar123"),
+		})
+		server.Policy = &bcnetgo.AccessList{
+			Readers: map[string][]string{
+				"Test": {"Alice"},
+			},
+		}
+		server.Verify = bcnetgo.RSAAliasVerifier(func(alias string) (*rsa.PublicKey, error) {
+			return &key.PublicKey, nil
+		})
+		testinggo.AssertNoError(t, server.Start())
+		defer server.Shutdown(context.Background())
+		dial := func(port int, certificate tls.Certificate) net.Conn {
+			conn, err := tls.Dial("tcp", server.Addr(port).String(), &tls.Config{
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{certificate},
+			})
+			testinggo.AssertNoError(t, err)
+			return conn
+		}
+
+		conn := dial(network.PORT_CONNECT, clientCertificate)
+		_, err = bcnetgo.Connect(conn, "Alice", bcnetgo.RSASigner(key))
+		conn.Close()
+		testinggo.AssertNoError(t, err)
+
+		conn = dial(network.PORT_GET_HEAD, clientCertificate)
+		_, err = bcnetgo.RequestHead(conn, "Test")
+		conn.Close()
+		testinggo.AssertNoError(t, err)
+
+		// Another certificate from the same address is not authorized
+		conn = dial(network.PORT_GET_HEAD, otherCertificate)
+		_, err = bcnetgo.RequestHead(conn, "Test")
+		conn.Close()
+		expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+	})
+	t.Run("Plaintext", func(t *testing.T) {
+		server := makeTLSServer(t)
+		defer server.Shutdown(context.Background())
+
+		client, err := net.Dial("tcp", server.Addr(network.PORT_GET_HEAD).String())
+		testinggo.AssertNoError(t, err)
+		defer client.Close()
+
+		if _, err := requestHead(client); err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+}
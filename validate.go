@@ -0,0 +1,45 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"aletheiaware.com/bcgo"
+	"fmt"
+)
+
+// BlockValidator inspects a broadcast block before it is passed to channel.Update, returning an error to reject it.
+// Ancestors holds the blocks back-filled from the broadcaster, newest first.
+type BlockValidator func(hash []byte, block *bcgo.Block, ancestors []*bcgo.Block) error
+
+// ErrValidationFailed is returned when a validator rejects a broadcast block.
+type ErrValidationFailed struct {
+	Reason string
+}
+
+func (e ErrValidationFailed) Error() string {
+	return fmt.Sprintf("Validation failed: %s", e.Reason)
+}
+
+// validate runs the validators configured for the channel in order, stopping at the first to reject the block.
+func (s *Server) validate(channel string, hash []byte, block *bcgo.Block, ancestors []*bcgo.Block) error {
+	for _, v := range s.Validators[channel] {
+		if err := v(hash, block, ancestors); err != nil {
+			return ErrValidationFailed{err.Error()}
+		}
+	}
+	return nil
+}
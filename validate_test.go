@@ -0,0 +1,147 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/channel"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// broadcast sends the block with the given hash from source to the server, and returns the server's final response.
+func broadcast(t *testing.T, server *bcnetgo.Server, source bcgo.Cache, hash []byte) *bcnetgo.Response {
+	t.Helper()
+	s, client := net.Pipe()
+	defer client.Close()
+	go server.BroadcastPortTCPHandler(s)
+	block, err := source.Block(hash)
+	testinggo.AssertNoError(t, err)
+	response, err := bcnetgo.Broadcast(client, source, block)
+	testinggo.AssertNoError(t, err)
+	return response
+}
+
+func TestValidators(t *testing.T) {
+	source, hashes := makeChain(t, 3)
+	makeServer := func(validators map[string][]bcnetgo.BlockValidator) (*bcnetgo.Server, bcgo.Channel) {
+		channel := channel.New("Test")
+		open := func(name string) (bcgo.Channel, error) {
+			return channel, nil
+		}
+		server := bcnetgo.NewServer(cache.NewMemory(10), makeNetwork(t), open)
+		server.Validators = validators
+		return server, channel
+	}
+	accept := func([]byte, *bcgo.Block, []*bcgo.Block) error {
+		return nil
+	}
+	reject := func([]byte, *bcgo.Block, []*bcgo.Block) error {
+		return errors.New("Miner not permitted")
+	}
+	t.Run("Accepted", func(t *testing.T) {
+		var ancestors []*bcgo.Block
+		server, channel := makeServer(map[string][]bcnetgo.BlockValidator{
+			"Test": {
+				func(hash []byte, block *bcgo.Block, a []*bcgo.Block) error {
+					ancestors = a
+					return nil
+				},
+			},
+		})
+		response := broadcast(t, server, source, hashes[0])
+		if response.Status != bcnetgo.STATUS_OK {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_OK, response.Status)
+		}
+		if len(ancestors) != 2 || ancestors[0].Length != 2 || ancestors[1].Length != 1 {
+			t.Fatal("Incorrect ancestors")
+		}
+		if channel.Head() == nil {
+			t.Fatal("Expected channel to be updated")
+		}
+	})
+	t.Run("Rejected", func(t *testing.T) {
+		called := false
+		server, channel := makeServer(map[string][]bcnetgo.BlockValidator{
+			"Test": {
+				accept,
+				reject,
+				func([]byte, *bcgo.Block, []*bcgo.Block) error {
+					called = true
+					return nil
+				},
+			},
+		})
+		response := broadcast(t, server, source, hashes[0])
+		if response.Status != bcnetgo.STATUS_BAD_REQUEST {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_BAD_REQUEST, response.Status)
+		}
+		if response.Outcome != bcnetgo.OUTCOME_VALIDATION_FAILED {
+			t.Fatalf("Incorrect outcome; expected '%s', got '%s'", bcnetgo.OUTCOME_VALIDATION_FAILED, response.Outcome)
+		}
+		if !strings.Contains(response.Message, "Miner not permitted") {
+			t.Fatalf("Incorrect message; got '%s'", response.Message)
+		}
+		if called {
+			t.Fatal("Expected validation to stop at first rejection")
+		}
+		if channel.Head() != nil {
+			t.Fatal("Expected channel to not be updated")
+		}
+		if _, err := server.Cache.Block(hashes[1]); err == nil {
+			t.Fatal("Expected back-filled block to not be persisted")
+		}
+	})
+	t.Run("RejectedLegacy", func(t *testing.T) {
+		server, _ := makeServer(map[string][]bcnetgo.BlockValidator{
+			"Test": {
+				reject,
+			},
+		})
+		genesis, err := source.Block(hashes[2])
+		testinggo.AssertNoError(t, err)
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BroadcastPortTCPHandler(s)
+		testinggo.AssertNoError(t, bcgo.WriteDelimitedProtobuf(bufio.NewWriter(client), genesis))
+
+		// Expect legacy peers to not be sent a head as if the update succeeded
+		if err := bcgo.ReadDelimitedProtobuf(bufio.NewReader(client), &bcgo.Reference{}); err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+	t.Run("OtherChannel", func(t *testing.T) {
+		server, channel := makeServer(map[string][]bcnetgo.BlockValidator{
+			"Other": {
+				reject,
+			},
+		})
+		response := broadcast(t, server, source, hashes[0])
+		if response.Status != bcnetgo.STATUS_OK {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_OK, response.Status)
+		}
+		if channel.Head() == nil {
+			t.Fatal("Expected channel to be updated")
+		}
+	})
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+const (
+	// FEATURE_AUTHENTICATION indicates the server challenges peers to prove their alias.
+	FEATURE_AUTHENTICATION = "authentication"
+	// FEATURE_RANGE indicates the get block port streams ranges of blocks.
+	FEATURE_RANGE = "range"
+	// FEATURE_PEER_EXCHANGE indicates the connect port shares known peers with clients which ask for them.
+	FEATURE_PEER_EXCHANGE = "peers"
+	// FEATURE_SUBSCRIBE indicates the get head port pushes head changes to clients which subscribe.
+	FEATURE_SUBSCRIBE = "subscribe"
+	// FEATURE_SNAPSHOT indicates the get block port sends snapshots of channels.
+	FEATURE_SNAPSHOT = "snapshot"
+)
+
+// SupportedVersions lists the protocol versions implemented by this package, excluding the legacy protocol.
+var SupportedVersions = []uint64{
+	PROTOCOL_VERSION,
+}
+
+// SupportedFeatures lists the optional features implemented by this package.
+var SupportedFeatures = []string{
+	FEATURE_AUTHENTICATION,
+	FEATURE_RANGE,
+	FEATURE_PEER_EXCHANGE,
+	FEATURE_SUBSCRIBE,
+	FEATURE_SNAPSHOT,
+}
+
+// Capabilities describes the protocol version and features agreed with a peer during the connect handshake.
+type Capabilities struct {
+	Version  uint64
+	Features []string
+}
+
+// Has returns true if the given feature was agreed.
+func (c Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities returns the capabilities the given peer negotiated when it last connected.
+func (s *Server) Capabilities(peer string) (Capabilities, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c, ok := s.capabilities[peer]
+	return c, ok
+}
+
+func (s *Server) setCapabilities(peer string, capabilities Capabilities) {
+	s.mutex.Lock()
+	s.capabilities[peer] = capabilities
+	s.mutex.Unlock()
+}
+
+func (s *Server) versions() []uint64 {
+	if len(s.Versions) == 0 {
+		return SupportedVersions
+	}
+	return s.Versions
+}
+
+// features returns the features offered to peers.
+func (s *Server) features() []string {
+	var features []string
+	for _, f := range s.Features {
+		if f == FEATURE_AUTHENTICATION && s.Verify == nil {
+			// Cannot authenticate peers
+			continue
+		}
+		features = append(features, f)
+	}
+	return features
+}
+
+func (s *Server) supportsVersion(version uint64) bool {
+	for _, v := range s.versions() {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateVersion returns the highest version offered by the peer which the server supports.
+func (s *Server) negotiateVersion(offered []uint64) (uint64, bool) {
+	var version uint64
+	for _, v := range offered {
+		if v > version && s.supportsVersion(v) {
+			version = v
+		}
+	}
+	return version, version > 0
+}
+
+// intersectFeatures returns the features found in both a and b.
+func intersectFeatures(a, b []string) []string {
+	var features []string
+	for _, f := range a {
+		for _, g := range b {
+			if f == g {
+				features = append(features, f)
+				break
+			}
+		}
+	}
+	return features
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/channel"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/cryptogo"
+	"aletheiaware.com/testinggo"
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	t.Run("Negotiated", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		s, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			server.ConnectPortTCPHandler(s)
+			close(done)
+		}()
+		capabilities, err := bcnetgo.Connect(client, "Alice", func([]byte) ([]byte, error) {
+			t.Fatal("Expected no challenge")
+			return nil, nil
+		})
+		testinggo.AssertNoError(t, err)
+		client.Close()
+		<-done
+		if capabilities.Version != bcnetgo.PROTOCOL_VERSION {
+			t.Fatalf("Incorrect version; expected '%d', got '%d'", bcnetgo.PROTOCOL_VERSION, capabilities.Version)
+		}
+		if capabilities.Has(bcnetgo.FEATURE_AUTHENTICATION) {
+			t.Fatal("Expected authentication to not be offered without a verifier")
+		}
+		recorded, ok := server.Capabilities("Alice")
+		if !ok {
+			t.Fatal("Expected capabilities to be recorded")
+		}
+		if recorded.Version != bcnetgo.PROTOCOL_VERSION {
+			t.Fatalf("Incorrect version; expected '%d', got '%d'", bcnetgo.PROTOCOL_VERSION, recorded.Version)
+		}
+	})
+	t.Run("NoCommonVersion", func(t *testing.T) {
+		network := makeNetwork(t)
+		server := bcnetgo.NewServer(nil, network, nil)
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.ConnectPortTCPHandler(s)
+		reader := bufio.NewReader(client)
+		writer := bufio.NewWriter(client)
+		testinggo.AssertNoError(t, bcnetgo.WritePreamble(writer, bcnetgo.PROTOCOL_VERSION))
+		testinggo.AssertNoError(t, bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.ClientHello{
+			Alias:    "Alice",
+			Versions: []uint64{99},
+		}))
+		hello := &bcnetgo.ServerHello{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(reader, hello, bcnetgo.MAX_HANDSHAKE_SIZE))
+		if hello.Version != 0 {
+			t.Fatalf("Incorrect version; expected '%d', got '%d'", 0, hello.Version)
+		}
+		if containsPeer(network, "Alice") {
+			t.Fatal("Expected peer to not be added to network")
+		}
+	})
+	t.Run("UnsupportedVersion", func(t *testing.T) {
+		c, hash, _ := makeCache(t)
+		server := bcnetgo.NewServer(c, nil, nil)
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BlockPortTCPHandler(s)
+		reader := bufio.NewReader(client)
+		writer := bufio.NewWriter(client)
+		testinggo.AssertNoError(t, bcnetgo.WritePreamble(writer, 99))
+		testinggo.AssertNoError(t, bcnetgo.WriteDelimitedMessage(writer, &bcnetgo.Request{
+			Reference: &bcgo.Reference{
+				ChannelName: "Test",
+				BlockHash:   hash,
+			},
+		}))
+		response := &bcnetgo.Response{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(reader, response, bcnetgo.DEFAULT_MAX_BLOCK_SIZE))
+		if response.Status != bcnetgo.STATUS_BAD_REQUEST {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_BAD_REQUEST, response.Status)
+		}
+	})
+	t.Run("BroadcastMissing", func(t *testing.T) {
+		block1 := &bcgo.Block{
+			Timestamp:   1234,
+			ChannelName: "Test",
+			Length:      1,
+		}
+		hash1, err := cryptogo.HashProtobuf(block1)
+		testinggo.AssertNoError(t, err)
+		block2 := &bcgo.Block{
+			Timestamp:   2345,
+			ChannelName: "Test",
+			Length:      2,
+			Previous:    hash1,
+		}
+		hash2, err := cryptogo.HashProtobuf(block2)
+		testinggo.AssertNoError(t, err)
+		channel := channel.New("Test")
+		open := func(name string) (bcgo.Channel, error) {
+			return channel, nil
+		}
+		server := bcnetgo.NewServer(cache.NewMemory(10), makeNetwork(t), open)
+		s, client := net.Pipe()
+		defer client.Close()
+		go server.BroadcastPortTCPHandler(s)
+		reader := bufio.NewReader(client)
+		writer := bufio.NewWriter(client)
+		testinggo.AssertNoError(t, bcnetgo.WritePreamble(writer, bcnetgo.PROTOCOL_VERSION))
+		testinggo.AssertNoError(t, bcgo.WriteDelimitedProtobuf(writer, block2))
+
+		// Expect server to ask for the missing block
+		response := &bcnetgo.Response{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(reader, response, bcnetgo.DEFAULT_MAX_BLOCK_SIZE))
+		if response.Missing == nil || !bytes.Equal(response.Missing.BlockHash, hash1) {
+			t.Fatalf("Incorrect missing reference; got '%v'", response.Missing)
+		}
+		testinggo.AssertNoError(t, bcgo.WriteDelimitedProtobuf(writer, block1))
+
+		// Expect server to reply with the updated head
+		response = &bcnetgo.Response{}
+		testinggo.AssertNoError(t, bcnetgo.ReadDelimitedMessage(reader, response, bcnetgo.DEFAULT_MAX_BLOCK_SIZE))
+		if response.Status != bcnetgo.STATUS_OK {
+			t.Fatalf("Incorrect status; expected '%s', got '%s'", bcnetgo.STATUS_OK, response.Status)
+		}
+		if response.Reference == nil || !bytes.Equal(response.Reference.BlockHash, hash2) {
+			t.Fatalf("Incorrect head; got '%v'", response.Reference)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo
+
+import (
+	"fmt"
+	"golang.org/x/net/websocket"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// wsConn reports the address of the HTTP client as its remote address, instead of the websocket origin,
+// so limits, bans, and peers apply to WebSocket connections as they do to TCP connections.
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// WebSocketHandler returns an HTTP handler which upgrades requests to WebSocket and serves the protocol of the given port,
+// or any protocol selected by a leading byte if the port is PORT_MULTIPLEX, with the same handler as the TCP port.
+// Messages are carried in binary frames as a stream, so the delimited protobufs are the same as over TCP.
+// Browsers may only connect from the origins in WebSocketOrigins, or the handler's own origin if it is empty.
+// An alias verified on the connect port never authorizes a WebSocket connection, as any page the peer visits could make one.
+func (s *Server) WebSocketHandler(port int) http.Handler {
+	handler := s.MultiplexHandler
+	if port != PORT_MULTIPLEX {
+		handler = s.Handlers()[port]
+	}
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, request *http.Request) error {
+			if !s.allowedOrigin(request) {
+				err := fmt.Errorf("Origin not allowed: %s", request.Header.Get("Origin"))
+				log.Println(request.RemoteAddr, err)
+				return err
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			conn := &wsConn{
+				Conn:   ws,
+				remote: s.clientAddr(ws.Request()),
+			}
+			ip, err := s.accept(port, conn)
+			if err == errRateLimited {
+				log.Println(conn.RemoteAddr(), err)
+				s.rejectRateLimited(conn)
+				return
+			} else if err != nil {
+				log.Println(conn.RemoteAddr(), err)
+				return
+			}
+			defer s.finish(conn, ip)
+			handler(s.withTimeouts(conn))
+		},
+	}
+}
+
+// allowedOrigin returns true if the request is not from a browser, which always sends an Origin,
+// or its origin is listed in WebSocketOrigins, or WebSocketOrigins is empty and the origin is the handler's own.
+func (s *Server) allowedOrigin(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(s.WebSocketOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == request.Host
+	}
+	for _, o := range s.WebSocketOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client which made the request. If the request came from a proxy in TrustedProxies,
+// the X-Forwarded-For header is walked from the right, skipping trusted proxies, to the first address added by an untrusted one.
+func (s *Server) clientAddr(request *http.Request) net.Addr {
+	address := request.RemoteAddr
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || !s.trustedProxy(host) {
+		return httpAddr(address)
+	}
+	var forwarded []string
+	for _, v := range request.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(v, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		address = net.JoinHostPort(ip.String(), "0")
+		if !s.trustedProxy(ip.String()) {
+			break
+		}
+	}
+	return httpAddr(address)
+}
+
+// trustedProxy returns true if the given IP matches an address or CIDR range in TrustedProxies.
+func (s *Server) trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, p := range s.TrustedProxies {
+		if strings.Contains(p, "/") {
+			if _, network, err := net.ParseCIDR(p); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if other := net.ParseIP(p); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWebSocket returns true if the connection was accepted by a WebSocketHandler.
+func isWebSocket(conn net.Conn) bool {
+	if c, ok := conn.(*timeoutConn); ok {
+		conn = c.Conn
+	}
+	_, ok := conn.(*wsConn)
+	return ok
+}
+
+// DialWebSocket connects to a WebSocketHandler at the given URL, such as "wss://example.com/head",
+// and returns a connection which can be passed to the client functions, such as RequestHead.
+func DialWebSocket(url, origin string) (net.Conn, error) {
+	ws, err := websocket.Dial(url, "", origin)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// httpAddr is the address of an HTTP client, as given by http.Request.RemoteAddr.
+type httpAddr string
+
+func (a httpAddr) Network() string {
+	return "tcp"
+}
+
+func (a httpAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2019 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bcnetgo_test
+
+import (
+	"aletheiaware.com/bcgo"
+	"aletheiaware.com/bcgo/cache"
+	"aletheiaware.com/bcgo/channel"
+	"aletheiaware.com/bcgo/network"
+	"aletheiaware.com/bcnetgo"
+	"aletheiaware.com/testinggo"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketHandler(t *testing.T) {
+	source, hashes := makeChain(t, 2)
+	c := channel.New("Test")
+	server := bcnetgo.NewServer(cache.NewMemory(10), makeNetwork(t), func(string) (bcgo.Channel, error) {
+		return c, nil
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/head", server.WebSocketHandler(network.PORT_GET_HEAD))
+	mux.Handle("/broadcast", server.WebSocketHandler(network.PORT_BROADCAST))
+	mux.Handle("/multiplex", server.WebSocketHandler(bcnetgo.PORT_MULTIPLEX))
+	h := httptest.NewServer(mux)
+	defer h.Close()
+	url := "ws" + strings.TrimPrefix(h.URL, "http")
+
+	t.Run("Broadcast", func(t *testing.T) {
+		conn, err := bcnetgo.DialWebSocket(url+"/broadcast", h.URL)
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		block, err := source.Block(hashes[0])
+		testinggo.AssertNoError(t, err)
+		response, err := bcnetgo.Broadcast(conn, source, block)
+		testinggo.AssertNoError(t, err)
+		if response.Outcome != bcnetgo.OUTCOME_ACCEPTED {
+			t.Fatalf("Incorrect outcome; expected '%s', got '%s'", bcnetgo.OUTCOME_ACCEPTED, response.Outcome)
+		}
+	})
+	t.Run("Head", func(t *testing.T) {
+		conn, err := bcnetgo.DialWebSocket(url+"/head", h.URL)
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		head, err := bcnetgo.RequestHead(conn, "Test")
+		testinggo.AssertNoError(t, err)
+		if !bytes.Equal(hashes[0], head.BlockHash) {
+			t.Fatalf("Incorrect hash; expected '%x', got '%x'", hashes[0], head.BlockHash)
+		}
+	})
+	t.Run("Multiplex", func(t *testing.T) {
+		conn, err := bcnetgo.DialWebSocket(url+"/multiplex", h.URL)
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		testinggo.AssertNoError(t, bcnetgo.SelectProtocol(conn, network.PORT_GET_HEAD))
+		head, err := bcnetgo.RequestHead(conn, "Test")
+		testinggo.AssertNoError(t, err)
+		if !bytes.Equal(hashes[0], head.BlockHash) {
+			t.Fatalf("Incorrect hash; expected '%x', got '%x'", hashes[0], head.BlockHash)
+		}
+	})
+	t.Run("OriginRejected", func(t *testing.T) {
+		if _, err := bcnetgo.DialWebSocket(url+"/head", "http://example.com"); err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+	t.Run("OriginAllowed", func(t *testing.T) {
+		server := bcnetgo.NewServer(cache.NewMemory(10), nil, nil)
+		server.WebSocketOrigins = []string{"http://example.com"}
+		h := httptest.NewServer(server.WebSocketHandler(network.PORT_GET_HEAD))
+		defer h.Close()
+
+		conn, err := bcnetgo.DialWebSocket("ws"+strings.TrimPrefix(h.URL, "http"), "http://example.com")
+		testinggo.AssertNoError(t, err)
+		conn.Close()
+	})
+	t.Run("NoAlias", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		testinggo.AssertNoError(t, err)
+		source, _ := makeChain(t, 1)
+		server := bcnetgo.NewServer(source, makeNetwork(t), nil)
+		server.Policy = &bcnetgo.AccessList{
+			Readers: map[string][]string{
+				"Test": {"Alice"},
+			},
+		}
+		server.Verify = bcnetgo.RSAAliasVerifier(func(alias string) (*rsa.PublicKey, error) {
+			return &key.PublicKey, nil
+		})
+		server.Identities = []string{"127.0.0.1"}
+		mux := http.NewServeMux()
+		mux.Handle("/connect", server.WebSocketHandler(network.PORT_CONNECT))
+		mux.Handle("/head", server.WebSocketHandler(network.PORT_GET_HEAD))
+		h := httptest.NewServer(mux)
+		defer h.Close()
+		url := "ws" + strings.TrimPrefix(h.URL, "http")
+
+		conn, err := bcnetgo.DialWebSocket(url+"/connect", h.URL)
+		testinggo.AssertNoError(t, err)
+		_, _, err = bcnetgo.ConnectWith(conn, &bcnetgo.ClientHello{
+			Alias:  "Alice",
+			Server: strings.TrimPrefix(h.URL, "http://"),
+		}, bcnetgo.RSASigner(key))
+		conn.Close()
+		testinggo.AssertNoError(t, err)
+
+		// A verified alias does not authorize WebSocket connections from the same address
+		conn, err = bcnetgo.DialWebSocket(url+"/head", h.URL)
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		_, err = bcnetgo.RequestHead(conn, "Test")
+		expectStatus(t, bcnetgo.STATUS_FORBIDDEN, err)
+	})
+	t.Run("Banned", func(t *testing.T) {
+		server := bcnetgo.NewServer(cache.NewMemory(10), nil, nil)
+		server.Reputation, _ = bcnetgo.NewReputation("")
+		testinggo.AssertNoError(t, server.Reputation.Ban("127.0.0.1", 0))
+		h := httptest.NewServer(server.WebSocketHandler(network.PORT_GET_HEAD))
+		defer h.Close()
+
+		conn, err := bcnetgo.DialWebSocket("ws"+strings.TrimPrefix(h.URL, "http"), h.URL)
+		testinggo.AssertNoError(t, err)
+		defer conn.Close()
+		if _, err := bcnetgo.RequestHead(conn, "Test"); err == nil {
+			t.Fatal("Expected error")
+		}
+		if got := server.Metrics().Banned; got != 1 {
+			t.Fatalf("Incorrect banned count; expected '%d', got '%d'", 1, got)
+		}
+	})
+	t.Run("TrustedProxy", func(t *testing.T) {
+		dial := func(t *testing.T, server *bcnetgo.Server) {
+			t.Helper()
+			h := httptest.NewServer(server.WebSocketHandler(network.PORT_GET_HEAD))
+			defer h.Close()
+			config, err := websocket.NewConfig("ws"+strings.TrimPrefix(h.URL, "http"), h.URL)
+			testinggo.AssertNoError(t, err)
+			config.Header.Set("X-Forwarded-For", "203.0.113.7")
+			conn, err := websocket.DialConfig(config)
+			testinggo.AssertNoError(t, err)
+			defer conn.Close()
+			conn.PayloadType = websocket.BinaryFrame
+			bcnetgo.RequestHead(conn, "Test")
+		}
+		ban := func(t *testing.T) *bcnetgo.Server {
+			t.Helper()
+			server := bcnetgo.NewServer(cache.NewMemory(10), nil, nil)
+			server.Reputation, _ = bcnetgo.NewReputation("")
+			testinggo.AssertNoError(t, server.Reputation.Ban("203.0.113.7", 0))
+			return server
+		}
+		t.Run("Trusted", func(t *testing.T) {
+			server := ban(t)
+			server.TrustedProxies = []string{"127.0.0.0/8"}
+			dial(t, server)
+			if got := server.Metrics().Banned; got != 1 {
+				t.Fatalf("Incorrect banned count; expected '%d', got '%d'", 1, got)
+			}
+		})
+		t.Run("Untrusted", func(t *testing.T) {
+			server := ban(t)
+			dial(t, server)
+			if got := server.Metrics().Banned; got != 0 {
+				t.Fatalf("Incorrect banned count; expected '%d', got '%d'", 0, got)
+			}
+		})
+	})
+}